@@ -0,0 +1,156 @@
+package dbrest
+
+import (
+	"fmt"
+	"github.com/go-xorm/core"
+	"path"
+	"strings"
+)
+
+// 只读操作, db.table.<表名>.operations 配置为 readonly 时使用
+var readonlyOperations = []string{"select", "get", "count", "aggregate", "schema"}
+
+// 表访问控制
+//
+// 配置:
+// {
+// 	"db.tables.include" : "user*, order*",
+// 	"db.tables.exclude" : "tmp_*, flyway_schema_history",
+// 	"db.hiddenColumns" : "password_hash, salt",
+// 	"db.table.user.operations" : "readonly",
+// 	"db.table.user.hiddenColumns" : "id_card"
+// }
+//
+// 命名数据源使用 db.<name>.tables.include, db.<name>.table.<表名>.operations 等配置
+//
+// include, exclude 使用表名或通配符, 未配置 include 时包含所有表, exclude 优先
+//
+// operations 为允许的操作, 例如 "select, get, count", 未配置时允许所有操作
+//
+// hiddenColumns 为隐藏列, 查询结果及表结构中不返回, 不能用于查询列, 过滤条件, 排序及聚合
+//
+// sql接口不受限制, 可通过 db.sqlApi 关闭
+func (this *DbApi) tableExposed(tableName string) bool {
+	// 审计记录表不提供通用接口, 避免被修改
+	if auditEnabled() && tableName == auditLogTable() {
+		return false
+	}
+	if matchTable(datasourceConf(this.name, "tables.exclude"), tableName) {
+		return false
+	}
+	include := datasourceConf(this.name, "tables.include")
+	return len(include) <= 0 || matchTable(include, tableName)
+}
+
+// 表名是否匹配逗号分隔的表名或通配符
+func matchTable(patterns string, tableName string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) <= 0 {
+			continue
+		}
+		if matched, err := path.Match(pattern, tableName); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 表是否允许操作
+func (this *DbApi) operationAllowed(tableName string, operation string) bool {
+	operations := datasourceConf(this.name, fmt.Sprintf("table.%s.operations", tableName))
+	if len(operations) <= 0 {
+		return true
+	}
+	for _, item := range strings.Split(operations, ",") {
+		item = strings.TrimSpace(item)
+		if item == operation {
+			return true
+		}
+		if item == "readonly" {
+			for _, readonly := range readonlyOperations {
+				if readonly == operation {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// 获取表的隐藏列, 列名为小写
+func (this *DbApi) hiddenColumns(tableName string) map[string]bool {
+	res := make(map[string]bool)
+	for _, key := range []string{"hiddenColumns", fmt.Sprintf("table.%s.hiddenColumns", tableName)} {
+		for _, columnName := range strings.Split(datasourceConf(this.name, key), ",") {
+			if columnName = strings.TrimSpace(columnName); len(columnName) > 0 {
+				res[strings.ToLower(columnName)] = true
+			}
+		}
+	}
+	return res
+}
+
+// 获取可见的列, 不存在或为隐藏列时返回nil
+func (this *DbApi) visibleColumn(tableMeta core.Table, columnName string) *core.Column {
+	column := tableMeta.GetColumn(columnName)
+	if column == nil || this.hiddenColumns(tableMeta.Name)[strings.ToLower(column.Name)] {
+		return nil
+	}
+	return column
+}
+
+// 获取所有可见的列
+func (this *DbApi) visibleColumns(tableMeta core.Table) []*core.Column {
+	hidden := this.hiddenColumns(tableMeta.Name)
+	columns := make([]*core.Column, 0)
+	for _, column := range tableMeta.Columns() {
+		if !hidden[strings.ToLower(column.Name)] {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// 去除表结构中的隐藏列, 索引只保留可见的列, 只包含隐藏列的索引不返回
+func (this *DbApi) visibleTable(tableMeta core.Table) core.Table {
+	hidden := this.hiddenColumns(tableMeta.Name)
+	visibleNames := func(names []string) []string {
+		res := make([]string, 0, len(names))
+		for _, name := range names {
+			if !hidden[strings.ToLower(name)] {
+				res = append(res, name)
+			}
+		}
+		return res
+	}
+	visibleName := func(name string) string {
+		if hidden[strings.ToLower(name)] {
+			return ""
+		}
+		return name
+	}
+	res := tableMeta
+	res.Indexes = make(map[string]*core.Index, len(tableMeta.Indexes))
+	for name, index := range tableMeta.Indexes {
+		cols := visibleNames(index.Cols)
+		if len(cols) <= 0 {
+			continue
+		}
+		visibleIndex := *index
+		visibleIndex.Cols = cols
+		res.Indexes[name] = &visibleIndex
+	}
+	res.PrimaryKeys = visibleNames(tableMeta.PrimaryKeys)
+	res.Created = make(map[string]bool, len(tableMeta.Created))
+	for name, created := range tableMeta.Created {
+		if len(visibleName(name)) > 0 {
+			res.Created[name] = created
+		}
+	}
+	res.AutoIncrement = visibleName(tableMeta.AutoIncrement)
+	res.Updated = visibleName(tableMeta.Updated)
+	res.Deleted = visibleName(tableMeta.Deleted)
+	res.Version = visibleName(tableMeta.Version)
+	return res
+}
@@ -0,0 +1,208 @@
+package dbrest
+
+import (
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/wenlaizhou/middleware"
+	"strings"
+	"time"
+)
+
+// 请求人参数, sql配置中可通过 ${principal.id} 使用
+const principalParam = "principal.id"
+
+// 审计时间格式
+const auditTimeLayout = "2006-01-02 15:04:05"
+
+// 审计列策略
+//
+// 全局配置:
+// {
+// 	"db.audit.createTime" : "create_time",
+// 	"db.audit.updateTime" : "update_time",
+// 	"db.audit.createdBy" : "created_by",
+// 	"db.audit.updatedBy" : "updated_by",
+// 	"db.audit.utc" : false,
+// 	"db.audit.principalHeader" : "X-User"
+// }
+//
+// 按表配置 db.audit.<表名>.createTime 等, 优先于全局配置, 配置为 - 时该表不使用对应的列
+//
+// 审计时间使用数据源的时区写入, 与读取时一致, 见 datasourceLocation, utc 不支持按表配置
+//
+// createdBy, updatedBy 默认不启用, 表中不存在的列忽略
+//
+// principalHeader 默认不启用, 请求头由客户端设置, 只应在可信的网关之后使用, 推荐使用 SetAuthenticator
+type auditPolicy struct {
+	createTime string
+	updateTime string
+	createdBy  string
+	updatedBy  string
+	loc        *time.Location
+}
+
+// 获取表的审计列策略
+func tableAudit(dbApi *DbApi, tableMeta core.Table) auditPolicy {
+	return auditPolicy{
+		createTime: auditColumn(tableMeta, "createTime", "create_time"),
+		updateTime: auditColumn(tableMeta, "updateTime", "update_time"),
+		createdBy:  auditColumn(tableMeta, "createdBy", ""),
+		updatedBy:  auditColumn(tableMeta, "updatedBy", ""),
+		loc:        dbApi.loc,
+	}
+}
+
+// 获取审计配置, 表配置优先
+func auditConf(tableName string, key string) string {
+	value := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), fmt.Sprintf("db.audit.%s.%s", tableName, key)))
+	if len(value) > 0 {
+		return value
+	}
+	return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), fmt.Sprintf("db.audit.%s", key)))
+}
+
+// 获取审计列名, 未启用或表中不存在时返回空
+func auditColumn(tableMeta core.Table, key string, defaultName string) string {
+	columnName := auditConf(tableMeta.Name, key)
+	if len(columnName) <= 0 {
+		columnName = defaultName
+	}
+	if len(columnName) <= 0 || columnName == "-" {
+		return ""
+	}
+	column := tableMeta.GetColumn(columnName)
+	if column == nil {
+		return ""
+	}
+	return column.Name
+}
+
+// 是否为审计列, 审计列的值不使用请求参数
+func (this auditPolicy) isAuditColumn(columnName string) bool {
+	if len(columnName) <= 0 {
+		return false
+	}
+	switch columnName {
+	case this.createTime, this.updateTime, this.createdBy, this.updatedBy:
+		return true
+	}
+	return false
+}
+
+// 是否为只在新增时写入的审计列
+func (this auditPolicy) isCreateColumn(columnName string) bool {
+	return len(columnName) > 0 && (columnName == this.createTime || columnName == this.createdBy)
+}
+
+// 当前时间, 由程序生成, 保证不同数据库的行为一致
+func (this auditPolicy) now() string {
+	now := time.Now()
+	if this.loc != nil {
+		now = now.In(this.loc)
+	}
+	return now.Format(auditTimeLayout)
+}
+
+// 新增时的审计列及值
+func (this auditPolicy) insertColumns(confParams map[string]string) ([]string, []interface{}) {
+	return this.columns(confParams, true)
+}
+
+// 更新时的审计列及值
+func (this auditPolicy) updateColumns(confParams map[string]string) ([]string, []interface{}) {
+	return this.columns(confParams, false)
+}
+
+// 审计列及值, 同一语句中的时间一致
+func (this auditPolicy) columns(confParams map[string]string, create bool) ([]string, []interface{}) {
+	now := this.now()
+	principal := requestPrincipal(confParams)
+	columns := make([]string, 0)
+	var values []interface{}
+	if create && len(this.createTime) > 0 {
+		columns = append(columns, this.createTime)
+		values = append(values, now)
+	}
+	if create && len(this.createdBy) > 0 {
+		columns = append(columns, this.createdBy)
+		values = append(values, principal)
+	}
+	if len(this.updateTime) > 0 {
+		columns = append(columns, this.updateTime)
+		values = append(values, now)
+	}
+	if len(this.updatedBy) > 0 {
+		columns = append(columns, this.updatedBy)
+		values = append(values, principal)
+	}
+	return columns, values
+}
+
+// 更新时的审计set语句
+func (this auditPolicy) updateSet(dbApi *DbApi, confParams map[string]string) (string, []interface{}) {
+	columns, values := this.updateColumns(confParams)
+	set := ""
+	for _, columnName := range columns {
+		if len(set) > 0 {
+			set = fmt.Sprintf("%s, %s = ?", set, dbApi.quote(columnName))
+		} else {
+			set = fmt.Sprintf("%s = ?", dbApi.quote(columnName))
+		}
+	}
+	return set, values
+}
+
+// 获取请求人, 不存在时返回nil
+func requestPrincipal(confParams map[string]string) interface{} {
+	if principal, ok := confParams[principalParam]; ok && len(principal) > 0 {
+		return principal
+	}
+	return nil
+}
+
+// 请求相关的保留参数, 只能由服务端设置, 不使用请求参数中的同名值
+var reservedParams = []string{principalParam, remoteAddrParam}
+
+// 是否为保留参数
+func isReservedParam(key string) bool {
+	for _, reserved := range reservedParams {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// 补全保留参数, 不存在时为空, 保证sql配置中的保留参数不使用请求参数
+func seedReservedParams(params map[string]string) {
+	for _, reserved := range reservedParams {
+		if _, ok := params[reserved]; !ok {
+			params[reserved] = ""
+		}
+	}
+}
+
+// 获取请求相关的参数, 包括请求人及请求地址, 请求人不存在时为空
+//
+// 设置认证时请求人为认证结果, 否则使用 db.audit.principalHeader 配置的请求头, 未配置时没有请求人
+func requestParams(context middleware.Context) map[string]string {
+	params := make(map[string]string)
+	seedReservedParams(params)
+	params[remoteAddrParam] = context.RemoteAddr()
+	if principal, ok := authPrincipal(context); ok {
+		params[principalParam] = principal
+		return params
+	}
+	if loadState().authenticator != nil {
+		return params
+	}
+	// 请求头由客户端设置, 只在明确配置时使用
+	header := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.audit.principalHeader"))
+	if len(header) <= 0 {
+		return params
+	}
+	if principal := strings.TrimSpace(context.Request.Header.Get(header)); len(principal) > 0 {
+		params[principalParam] = principal
+	}
+	return params
+}
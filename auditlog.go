@@ -0,0 +1,291 @@
+package dbrest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"strings"
+	"time"
+)
+
+// 默认审计记录表名, 可通过 db.auditLog.table 配置
+const defaultAuditLogTable = "dbrest_audit_log"
+
+// 请求地址参数
+const remoteAddrParam = "request.remoteAddr"
+
+// 审计操作类型, 其余与sql配置类型一致
+const (
+	auditRestore = "restore"
+	auditSql     = "sql"
+)
+
+// 审计记录
+//
+// db.auditLog 配置为true时, 所有新增, 修改, 删除操作在同一事务中写入审计记录
+//
+// before, after 为操作前后的数据, changes 为变化的列, sql配置中的自定义sql记录sql语句及参数值
+//
+// sql配置的接口未开启事务时, 有写操作的接口同样在事务中执行
+type AuditLog struct {
+	Id         int64     `xorm:"'id' pk autoincr" json:"id"`
+	Target     string    `xorm:"'table_name' varchar(128) index" json:"tableName"`
+	PrimaryKey string    `xorm:"'primary_key' varchar(255)" json:"primaryKey"`
+	Operation  string    `xorm:"'operation' varchar(16)" json:"operation"`
+	Principal  string    `xorm:"'principal' varchar(128)" json:"principal"`
+	RemoteAddr string    `xorm:"'remote_addr' varchar(64)" json:"remoteAddr"`
+	Before     string    `xorm:"'before_image' text" json:"before"`
+	After      string    `xorm:"'after_image' text" json:"after"`
+	Changes    string    `xorm:"'changes' text" json:"changes"`
+	SqlText    string    `xorm:"'sql_text' text" json:"sql"`
+	SqlParams  string    `xorm:"'sql_params' text" json:"sqlParams"`
+	CreateTime time.Time `xorm:"'create_time' index" json:"createTime"`
+}
+
+func (this *AuditLog) TableName() string {
+	return auditLogTable()
+}
+
+// 是否开启审计记录
+func auditEnabled() bool {
+	return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.auditLog")) == "true"
+}
+
+// 审计记录表名
+func auditLogTable() string {
+	tableName := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.auditLog.table"))
+	if len(tableName) <= 0 {
+		return defaultAuditLogTable
+	}
+	return tableName
+}
+
+// 开启审计记录时同步数据源的审计记录表结构
+func initAuditLog(dbApi *DbApi) {
+	if !auditEnabled() {
+		return
+	}
+	middleware.ProcessError(dbApi.GetEngine().Sync2(new(AuditLog)))
+}
+
+// 写入数据操作审计记录, before, after 不存在时为nil
+func writeAuditLog(session xorm.Session, tableName string, operation string, primaryKey interface{},
+	before interface{}, after interface{}, confParams map[string]string) error {
+
+	if !auditEnabled() {
+		return nil
+	}
+	beforeMap := auditMap(before)
+	afterMap := auditMap(after)
+	return insertAuditLog(session, &AuditLog{
+		Target:     tableName,
+		PrimaryKey: auditKey(primaryKey),
+		Operation:  operation,
+		Before:     auditJson(beforeMap),
+		After:      auditJson(afterMap),
+		Changes:    auditJson(auditChanges(beforeMap, afterMap)),
+	}, confParams)
+}
+
+// 写入自定义sql审计记录, 记录sql语句及参数值, 参数值为json数组
+func writeSqlAuditLog(session xorm.Session, tableName string, sqlText string, values []interface{},
+	confParams map[string]string) error {
+
+	if !auditEnabled() {
+		return nil
+	}
+	return insertAuditLog(session, &AuditLog{
+		Target:    tableName,
+		Operation: auditSql,
+		SqlText:   sqlText,
+		SqlParams: auditJson(values),
+	}, confParams)
+}
+
+func insertAuditLog(session xorm.Session, auditLog *AuditLog, confParams map[string]string) error {
+	auditLog.Principal = confParams[principalParam]
+	auditLog.RemoteAddr = confParams[remoteAddrParam]
+	auditLog.CreateTime = time.Now()
+	_, err := session.Insert(auditLog)
+	return err
+}
+
+// 审计数据转换为map, 结构体使用json字段名
+func auditMap(v interface{}) map[string]interface{} {
+	switch realValue := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		return realValue
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	res := make(map[string]interface{})
+	if err = json.Unmarshal(data, &res); err != nil {
+		return nil
+	}
+	return res
+}
+
+// 获取变化的列, {"列名" : {"before" : 原值, "after" : 新值}}
+func auditChanges(before map[string]interface{}, after map[string]interface{}) map[string]interface{} {
+	if before == nil && after == nil {
+		return nil
+	}
+	changes := make(map[string]interface{})
+	keys := make(map[string]interface{})
+	for k := range before {
+		keys[k] = nil
+	}
+	for k := range after {
+		keys[k] = nil
+	}
+	for _, k := range sortedKeys(keys) {
+		if auditJson(before[k]) == auditJson(after[k]) {
+			continue
+		}
+		changes[k] = map[string]interface{}{
+			"before": before[k],
+			"after":  after[k],
+		}
+	}
+	return changes
+}
+
+// 审计数据json, nil时为空
+func auditJson(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if m, ok := v.(map[string]interface{}); ok && m == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// 主键值, 单一主键时为值本身, 复合主键时为json
+func auditKey(primaryKey interface{}) string {
+	switch realValue := primaryKey.(type) {
+	case nil:
+		return ""
+	case map[string]interface{}:
+		if len(realValue) == 1 {
+			for _, v := range realValue {
+				return fmt.Sprintf("%v", v)
+			}
+		}
+		return auditJson(realValue)
+	case core.PK:
+		if len(realValue) == 1 {
+			return fmt.Sprintf("%v", realValue[0])
+		}
+		return auditJson([]interface{}(realValue))
+	}
+	return fmt.Sprintf("%v", primaryKey)
+}
+
+// 获取数据的主键值, 主键不完整时返回nil
+func primaryValues(tableMeta core.Table, row map[string]interface{}) map[string]interface{} {
+	if len(tableMeta.PrimaryKeys) <= 0 {
+		return nil
+	}
+	primaryKey := make(map[string]interface{})
+	for _, primaryKeyName := range tableMeta.PrimaryKeys {
+		v, ok := row[primaryKeyName]
+		if !ok || v == nil || !isScalar(v) {
+			return nil
+		}
+		primaryKey[primaryKeyName] = v
+	}
+	return primaryKey
+}
+
+// 新增数据的主键值, id 为 doInsert 返回的主键
+func insertedKey(tableMeta core.Table, id interface{}) map[string]interface{} {
+	if primaryKey, ok := id.(map[string]interface{}); ok {
+		return primaryValues(tableMeta, primaryKey)
+	}
+	if id == nil || len(tableMeta.PrimaryKeys) != 1 {
+		return nil
+	}
+	return map[string]interface{}{tableMeta.PrimaryKeys[0]: id}
+}
+
+// 按主键查询审计数据镜像, 不包括隐藏列, 未开启审计或数据不存在时返回nil
+func auditImage(session xorm.Session, dbApi *DbApi, tableMeta core.Table,
+	primaryKey map[string]interface{}) (map[string]interface{}, error) {
+
+	if !auditEnabled() || primaryKey == nil {
+		return nil, nil
+	}
+	fields, err := buildFields(dbApi, tableMeta, nil)
+	if err != nil {
+		return nil, err
+	}
+	where := ""
+	var values []interface{}
+	for _, primaryKeyName := range tableMeta.PrimaryKeys {
+		where = appendCondition(where, fmt.Sprintf("%s = ?", dbApi.quote(primaryKeyName)))
+		values = append(values, primaryKey[primaryKeyName])
+	}
+	rows, err := queryRows(session, tableColumnTypes(tableMeta), dbApi.loc,
+		append([]interface{}{selectSql(dbApi, tableMeta.Name, fields, where, "", "")}, values...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) <= 0 {
+		return nil, nil
+	}
+	return rows[0], nil
+}
+
+// 按条件查询审计数据镜像, 不包括隐藏列, 最多返回最大影响行数加1条, 未开启审计时返回nil
+func auditImages(session xorm.Session, dbApi *DbApi, tableMeta core.Table, where string,
+	values []interface{}) ([]map[string]interface{}, error) {
+
+	if !auditEnabled() {
+		return nil, nil
+	}
+	fields, err := buildFields(dbApi, tableMeta, nil)
+	if err != nil {
+		return nil, err
+	}
+	return queryRows(session, tableColumnTypes(tableMeta), dbApi.loc,
+		append([]interface{}{selectSql(dbApi, tableMeta.Name, fields, where, "",
+			fmt.Sprintf("limit %d", maxAffectedRows()+1))}, values...)...)
+}
+
+// 查询操作后的数据镜像并写入审计记录
+func auditTableRow(session xorm.Session, dbApi *DbApi, tableMeta core.Table, operation string,
+	primaryKey map[string]interface{}, before map[string]interface{}, confParams map[string]string) error {
+
+	if !auditEnabled() {
+		return nil
+	}
+	after, err := auditImage(session, dbApi, tableMeta, primaryKey)
+	if err != nil {
+		return err
+	}
+	return writeAuditLog(session, tableMeta.Name, operation, primaryKey, before, after, confParams)
+}
+
+// 按条件操作后逐条写入审计记录
+func auditTableRows(session xorm.Session, dbApi *DbApi, tableMeta core.Table, operation string,
+	befores []map[string]interface{}, confParams map[string]string) error {
+
+	for _, before := range befores {
+		err := auditTableRow(session, dbApi, tableMeta, operation, primaryValues(tableMeta, before), before, confParams)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
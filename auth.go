@@ -0,0 +1,274 @@
+package dbrest
+
+import (
+	stdcontext "context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wenlaizhou/middleware"
+	"strings"
+	"time"
+)
+
+// 认证方式, 通过 db.auth 配置
+const (
+	AuthApiKey = "apiKey"
+	AuthJwt    = "jwt"
+)
+
+// 认证失败
+var ErrUnauthorized = errors.New("未认证或认证已失效")
+
+// 认证
+//
+// 返回请求人标识, 作为 ${principal.id} 及审计列的请求人, 认证失败时返回错误,
+// 返回空标识且没有错误时允许匿名访问
+type Authenticator interface {
+	Authenticate(context middleware.Context) (string, error)
+}
+
+// 请求上下文中的请求人
+type principalContextKey struct{}
+
+// 设置认证, 所有通用接口, RegisterDbApi, sql接口及sql配置接口在处理前认证, 为nil时不认证
+//
+// 设置认证后不再使用 db.audit.principalHeader 获取请求人
+func SetAuthenticator(authenticator Authenticator) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	updateState(func(s *runtimeState) {
+		s.authenticator = authenticator
+		s.authFromConfig = false
+	})
+}
+
+// 根据配置创建内置认证, 未配置 db.auth 时返回nil
+//
+// {
+// 	"db.auth" : "apiKey",
+// 	"db.auth.header" : "X-Api-Key",
+// 	"db.auth.apiKeys" : "key1:alice, key2:bob"
+// }
+//
+// {
+// 	"db.auth" : "jwt",
+// 	"db.auth.header" : "Authorization",
+// 	"db.auth.jwtSecret" : "",
+// 	"db.auth.principalClaim" : "sub"
+// }
+func configAuthenticator() (Authenticator, error) {
+	authConf := func(key string) string {
+		return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), fmt.Sprintf("db.auth.%s", key)))
+	}
+	switch auth := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.auth")); auth {
+	case "":
+		return nil, nil
+	case AuthApiKey:
+		keys := make(map[string]string)
+		for _, item := range strings.Split(authConf("apiKeys"), ",") {
+			item = strings.TrimSpace(item)
+			if len(item) <= 0 {
+				continue
+			}
+			index := strings.Index(item, ":")
+			if index <= 0 {
+				return nil, errors.New("认证配置错误, db.auth.apiKeys 格式为 key:principal")
+			}
+			keys[strings.TrimSpace(item[:index])] = strings.TrimSpace(item[index+1:])
+		}
+		if len(keys) <= 0 {
+			return nil, errors.New("认证配置错误, 没有配置 db.auth.apiKeys")
+		}
+		return &ApiKeyAuthenticator{
+			Header: authConf("header"),
+			Keys:   keys,
+		}, nil
+	case AuthJwt:
+		secret := authConf("jwtSecret")
+		if len(secret) <= 0 {
+			return nil, errors.New("认证配置错误, 没有配置 db.auth.jwtSecret")
+		}
+		return &JwtAuthenticator{
+			Header:         authConf("header"),
+			Secret:         []byte(secret),
+			PrincipalClaim: authConf("principalClaim"),
+		}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("认证配置错误, 不支持的认证方式 %s", auth))
+	}
+}
+
+// 认证后处理请求, 认证失败时返回 CodeUnauthorized
+func authHandler(handler func(context middleware.Context)) func(context middleware.Context) {
+	return func(context middleware.Context) {
+		authenticator := loadState().authenticator
+		if authenticator == nil {
+			handler(context)
+			return
+		}
+		principal, err := authenticator.Authenticate(context)
+		if err != nil {
+			Logger.InfoF("%s 认证失败: %s", context.RemoteAddr(), err.Error())
+			_ = context.ApiResponse(CodeUnauthorized, ErrUnauthorized.Error(), nil)
+			return
+		}
+		if len(principal) > 0 {
+			context.Request = context.Request.WithContext(
+				stdcontext.WithValue(context.Request.Context(), principalContextKey{}, principal))
+		}
+		handler(context)
+	}
+}
+
+// 认证后的请求人, 不存在时返回false
+func authPrincipal(context middleware.Context) (string, bool) {
+	principal, ok := context.Request.Context().Value(principalContextKey{}).(string)
+	return principal, ok
+}
+
+// 认证配置错误时拒绝所有请求
+type deniedAuthenticator struct {
+	err error
+}
+
+func (this deniedAuthenticator) Authenticate(context middleware.Context) (string, error) {
+	return "", this.err
+}
+
+// API key 认证, 请求头中的key对应请求人
+type ApiKeyAuthenticator struct {
+	// 默认 X-Api-Key
+	Header string
+	// key : 请求人
+	Keys map[string]string
+}
+
+func (this *ApiKeyAuthenticator) Authenticate(context middleware.Context) (string, error) {
+	header := this.Header
+	if len(header) <= 0 {
+		header = "X-Api-Key"
+	}
+	key := strings.TrimSpace(context.Request.Header.Get(header))
+	if len(key) <= 0 {
+		return "", ErrUnauthorized
+	}
+	principal, ok := "", false
+	// 比较所有key, 避免通过耗时推测key
+	for k, v := range this.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			principal, ok = v, true
+		}
+	}
+	if !ok {
+		return "", ErrUnauthorized
+	}
+	return principal, nil
+}
+
+// HS256 签名的 JWT 认证
+//
+// 校验签名及 exp, nbf, 使用 PrincipalClaim 对应的值作为请求人
+type JwtAuthenticator struct {
+	// 默认 Authorization, 值可带 Bearer 前缀
+	Header string
+	Secret []byte
+	// 默认 sub
+	PrincipalClaim string
+}
+
+func (this *JwtAuthenticator) Authenticate(context middleware.Context) (string, error) {
+	header := this.Header
+	if len(header) <= 0 {
+		header = "Authorization"
+	}
+	token := strings.TrimSpace(context.Request.Header.Get(header))
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	claims, err := this.verify(token)
+	if err != nil {
+		return "", err
+	}
+	principalClaim := this.PrincipalClaim
+	if len(principalClaim) <= 0 {
+		principalClaim = "sub"
+	}
+	principal, ok := claims[principalClaim]
+	if !ok || principal == nil {
+		return "", errors.New(fmt.Sprintf("token 中没有 %s", principalClaim))
+	}
+	if number, ok := principal.(json.Number); ok {
+		return number.String(), nil
+	}
+	return fmt.Sprintf("%v", principal), nil
+}
+
+// 校验token, 返回claims
+func (this *JwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token 格式错误")
+	}
+	header := make(map[string]interface{})
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if alg, _ := header["alg"].(string); alg != "HS256" {
+		return nil, errors.New(fmt.Sprintf("不支持的 token 签名算法 %v", header["alg"]))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("token 签名格式错误")
+	}
+	mac := hmac.New(sha256.New, this.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("token 签名错误")
+	}
+	claims := make(map[string]interface{})
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if exp, ok := jwtTime(claims["exp"]); ok && now >= exp {
+		return nil, errors.New("token 已过期")
+	}
+	if nbf, ok := jwtTime(claims["nbf"]); ok && now < nbf {
+		return nil, errors.New("token 尚未生效")
+	}
+	return claims, nil
+}
+
+// 解码token的header或claims
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("token 格式错误")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err = decoder.Decode(v); err != nil {
+		return errors.New("token 格式错误")
+	}
+	return nil
+}
+
+// 解析token中的时间, 单位秒
+func jwtTime(v interface{}) (int64, bool) {
+	number, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := number.Int64(); err == nil {
+		return i, true
+	}
+	f, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(f), true
+}
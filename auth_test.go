@@ -0,0 +1,204 @@
+package dbrest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/wenlaizhou/middleware"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJwtSecret = []byte("secret")
+
+// 生成测试token, 使用secret按HS256签名
+func testJwt(t *testing.T, secret []byte, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signing := encode(header) + "." + encode(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signing))
+	return signing + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 带请求头的上下文
+func testContext(header string, value string) middleware.Context {
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	if len(header) > 0 {
+		request.Header.Set(header, value)
+	}
+	return middleware.Context{Request: request, Response: httptest.NewRecorder()}
+}
+
+func TestJwtVerify(t *testing.T) {
+	now := time.Now().Unix()
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	valid := testJwt(t, testJwtSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now + 60})
+	// 修改claims, 保留原签名
+	validParts := strings.Split(valid, ".")
+	otherParts := strings.Split(testJwt(t, testJwtSecret, hs256, map[string]interface{}{"sub": "bob"}), ".")
+	tampered := strings.Join([]string{validParts[0], otherParts[1], validParts[2]}, ".")
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"bad signature", testJwt(t, []byte("other"), hs256, map[string]interface{}{"sub": "alice"}), false},
+		{"tampered claims", tampered, false},
+		{"alg none", testJwt(t, testJwtSecret, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "alice"}), false},
+		{"alg none without signature", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + ".", false},
+		{"alg HS512", testJwt(t, testJwtSecret, map[string]interface{}{"alg": "HS512"}, map[string]interface{}{"sub": "alice"}), false},
+		{"alg RS256", testJwt(t, testJwtSecret, map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"sub": "alice"}), false},
+		{"missing alg", testJwt(t, testJwtSecret, map[string]interface{}{"typ": "JWT"}, map[string]interface{}{"sub": "alice"}), false},
+		{"expired", testJwt(t, testJwtSecret, hs256, map[string]interface{}{"sub": "alice", "exp": now - 60}), false},
+		{"not yet valid", testJwt(t, testJwtSecret, hs256, map[string]interface{}{"sub": "alice", "nbf": now + 60}), false},
+		{"valid nbf", testJwt(t, testJwtSecret, hs256, map[string]interface{}{"sub": "alice", "nbf": now - 60}), true},
+		{"two parts", "a.b", false},
+		{"bad base64", "!.!.!", false},
+		{"empty", "", false},
+	}
+	authenticator := &JwtAuthenticator{Secret: testJwtSecret}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := authenticator.verify(c.token)
+			if c.ok && (err != nil || claims["sub"] != "alice") {
+				t.Fatalf("期望校验通过, claims %v, 错误 %v", claims, err)
+			}
+			if !c.ok && err == nil {
+				t.Fatalf("期望校验失败, claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestJwtAuthenticate(t *testing.T) {
+	token := testJwt(t, testJwtSecret, map[string]interface{}{"alg": "HS256"},
+		map[string]interface{}{"sub": "alice", "uid": 42})
+	cases := []struct {
+		name           string
+		header         string
+		value          string
+		principalClaim string
+		principal      string
+		ok             bool
+	}{
+		{"bearer", "Authorization", "Bearer " + token, "", "alice", true},
+		{"lowercase bearer", "Authorization", "bearer " + token, "", "alice", true},
+		{"without prefix", "Authorization", token, "", "alice", true},
+		{"numeric claim", "Authorization", "Bearer " + token, "uid", "42", true},
+		{"missing claim", "Authorization", "Bearer " + token, "name", "", false},
+		{"missing header", "", "", "", "", false},
+		{"bearer only", "Authorization", "Bearer", "", "", false},
+		{"bearer without space", "Authorization", "Bearer" + token, "", "", false},
+		{"basic", "Authorization", "Basic " + token, "", "", false},
+		{"other header", "X-Token", "Bearer " + token, "", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			authenticator := &JwtAuthenticator{Secret: testJwtSecret, PrincipalClaim: c.principalClaim}
+			principal, err := authenticator.Authenticate(testContext(c.header, c.value))
+			if c.ok && (err != nil || principal != c.principal) {
+				t.Fatalf("期望请求人 %s, 实际 %s, 错误 %v", c.principal, principal, err)
+			}
+			if !c.ok && err == nil {
+				t.Fatalf("期望认证失败, 请求人 %s", principal)
+			}
+		})
+	}
+}
+
+func TestApiKeyAuthenticate(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		value     string
+		principal string
+		ok        bool
+	}{
+		{"valid", "X-Api-Key", "key1", "alice", true},
+		{"trimmed", "X-Api-Key", " key2 ", "bob", true},
+		{"wrong key", "X-Api-Key", "key3", "", false},
+		{"key prefix", "X-Api-Key", "key", "", false},
+		{"empty key", "X-Api-Key", "", "", false},
+		{"missing header", "", "", "", false},
+		{"other header", "X-Token", "key1", "", false},
+	}
+	authenticator := &ApiKeyAuthenticator{Keys: map[string]string{"key1": "alice", "key2": "bob"}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(testContext(c.header, c.value))
+			if c.ok && (err != nil || principal != c.principal) {
+				t.Fatalf("期望请求人 %s, 实际 %s, 错误 %v", c.principal, principal, err)
+			}
+			if !c.ok && err == nil {
+				t.Fatalf("期望认证失败, 请求人 %s", principal)
+			}
+		})
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	apiKey := &ApiKeyAuthenticator{Keys: map[string]string{"key1": "alice"}}
+	cases := []struct {
+		name          string
+		authenticator Authenticator
+		key           string
+		code          int
+		principal     string
+	}{
+		{"no authenticator", nil, "", 0, ""},
+		{"valid key", apiKey, "key1", 0, "alice"},
+		{"wrong key", apiKey, "key2", CodeUnauthorized, ""},
+		{"missing key", apiKey, "", CodeUnauthorized, ""},
+		{"config error", deniedAuthenticator{err: ErrUnauthorized}, "key1", CodeUnauthorized, ""},
+	}
+	t.Cleanup(func() {
+		SetAuthenticator(nil)
+	})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			SetAuthenticator(c.authenticator)
+			called := false
+			handler := authHandler(func(context middleware.Context) {
+				called = true
+				principal, _ := authPrincipal(context)
+				_ = context.ApiResponse(0, "", principal)
+			})
+			request := httptest.NewRequest(http.MethodPost, "/", nil)
+			if len(c.key) > 0 {
+				request.Header.Set("X-Api-Key", c.key)
+			}
+			recorder := httptest.NewRecorder()
+			handler(middleware.Context{Request: request, Response: recorder})
+
+			var response struct {
+				Code int         `json:"code"`
+				Data interface{} `json:"data"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("响应格式错误 %s", recorder.Body.String())
+			}
+			if response.Code != c.code {
+				t.Fatalf("期望返回 %d, 实际 %d", c.code, response.Code)
+			}
+			if called != (c.code == 0) {
+				t.Fatalf("认证失败时不应处理请求")
+			}
+			if c.code == 0 && response.Data != c.principal {
+				t.Fatalf("期望请求人 %s, 实际 %v", c.principal, response.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package dbrest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-xorm/core"
+	"sort"
+	"strings"
+)
+
+// 条件操作符
+//
+// 使用方式:
+// {
+// 	"age" : {"gte" : 18, "lt" : 65},
+// 	"name" : {"like" : "%abc%"},
+// 	"status" : {"notIn" : [1, 2]},
+// 	"remark" : {"isNull" : true},
+// 	"create_time" : {"between" : ["2019-01-01", "2019-02-01"]}
+// }
+var compareOperators = map[string]string{
+	"eq":      "=",
+	"ne":      "<>",
+	"gt":      ">",
+	"gte":     ">=",
+	"lt":      "<",
+	"lte":     "<=",
+	"like":    "like",
+	"notLike": "not like",
+}
+
+// 根据请求参数构建where条件
+//
+// 只处理表中存在的列及条件组, 其余参数忽略
+//
+// 数组参数使用in查询, 对象参数使用操作符查询, 其余使用等值查询
+//
+// 条件组:
+// {
+// 	"$or" : [{"status" : 1}, {"owner" : "abc"}],
+// 	"$and" : [{"age" : {"gte" : 18}}, {"age" : {"lt" : 65}}],
+// 	"$not" : {"name" : {"like" : "test%"}}
+// }
+func buildWhere(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (string, []interface{}, error) {
+	return filterCondition(tableColumns(dbApi, tableMeta), requestJson, false)
+}
+
+// 条件中的参数名解析为sql表达式, 不存在时返回false
+type columnResolver func(key string) (string, bool)
+
+// 使用表中的列解析参数名, 隐藏列视为不存在, 列名按数据库方言引用
+func tableColumns(dbApi *DbApi, tableMeta core.Table) columnResolver {
+	return func(key string) (string, bool) {
+		column := dbApi.visibleColumn(tableMeta, key)
+		if column == nil {
+			return "", false
+		}
+		return dbApi.quote(column.Name), true
+	}
+}
+
+// 获取更新, 删除操作的附加条件 $where
+func buildExtraWhere(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (string, []interface{}, error) {
+	where, ok := requestJson["$where"]
+	if !ok || where == nil {
+		return "", nil, nil
+	}
+	filter, ok := where.(map[string]interface{})
+	if !ok {
+		return "", nil, errors.New("参数错误, $where 必须为对象")
+	}
+	return filterCondition(tableColumns(dbApi, tableMeta), filter, true)
+}
+
+// 表中存在is_delete字段且请求中未指定时, 只处理未删除数据
+//
+// "includeDeleted" : true 时包括已删除数据
+func notDeletedCondition(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) string {
+	isDelete := tableMeta.GetColumn("is_delete")
+	if isDelete == nil {
+		return ""
+	}
+	if includeDeleted, _ := requestJson["includeDeleted"].(bool); includeDeleted {
+		return ""
+	}
+	if _, ok := requestJson[isDelete.Name]; ok {
+		return ""
+	}
+	return fmt.Sprintf("%s = 0", dbApi.quote(isDelete.Name))
+}
+
+// 构建过滤条件
+//
+// strict 为true时, 不允许出现表中不存在的列
+func filterCondition(resolve columnResolver, filter map[string]interface{},
+	strict bool) (string, []interface{}, error) {
+
+	var values []interface{}
+	columnsStr := ""
+	for _, k := range sortedKeys(filter) {
+		var condition string
+		var conditionValues []interface{}
+		var err error
+		switch k {
+		case "$and", "$or":
+			condition, conditionValues, err = groupCondition(resolve, k, filter[k])
+			break
+		case "$not":
+			subFilter, ok := filter[k].(map[string]interface{})
+			if !ok {
+				return "", nil, errors.New("参数错误, $not 必须为对象")
+			}
+			condition, conditionValues, err = filterCondition(resolve, subFilter, true)
+			if len(condition) <= 0 {
+				condition = "1 = 1"
+			}
+			condition = fmt.Sprintf("not (%s)", condition)
+			break
+		default:
+			columnName, ok := resolve(k)
+			if !ok {
+				if strict {
+					return "", nil, errors.New(fmt.Sprintf("参数错误, 列 %s 不存在", k))
+				}
+				continue
+			}
+			condition, conditionValues, err = columnCondition(columnName, filter[k])
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		columnsStr = appendCondition(columnsStr, condition)
+		values = append(values, conditionValues...)
+	}
+	return columnsStr, values, nil
+}
+
+// 构建条件组, 空条件组时 $and 恒真, $or 恒假
+func groupCondition(resolve columnResolver, op string, v interface{}) (string, []interface{}, error) {
+	subFilters, ok := v.([]interface{})
+	if !ok {
+		return "", nil, errors.New(fmt.Sprintf("参数错误, %s 必须为数组", op))
+	}
+	if len(subFilters) <= 0 {
+		if op == "$or" {
+			return "1 = 0", nil, nil
+		}
+		return "", nil, nil
+	}
+	var values []interface{}
+	conditions := make([]string, 0, len(subFilters))
+	for _, sub := range subFilters {
+		subFilter, ok := sub.(map[string]interface{})
+		if !ok {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的元素必须为对象", op))
+		}
+		condition, conditionValues, err := filterCondition(resolve, subFilter, true)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(condition) <= 0 {
+			condition = "1 = 1"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s)", condition))
+		values = append(values, conditionValues...)
+	}
+	if op == "$or" {
+		return fmt.Sprintf("(%s)", strings.Join(conditions, " or ")), values, nil
+	}
+	return fmt.Sprintf("(%s)", strings.Join(conditions, " and ")), values, nil
+}
+
+// 构建单列条件
+func columnCondition(columnName string, v interface{}) (string, []interface{}, error) {
+	switch realValue := v.(type) {
+	case nil:
+		return "", nil, nil
+	case []interface{}:
+		return inCondition(columnName, "in", realValue)
+	case map[string]interface{}:
+		columnsStr := ""
+		var values []interface{}
+		for _, op := range sortedKeys(realValue) {
+			condition, conditionValues, err := operatorCondition(columnName, op, realValue[op])
+			if err != nil {
+				return "", nil, err
+			}
+			columnsStr = appendCondition(columnsStr, condition)
+			values = append(values, conditionValues...)
+		}
+		return columnsStr, values, nil
+	default:
+		return fmt.Sprintf("%s = ?", columnName), []interface{}{v}, nil
+	}
+}
+
+// 构建操作符条件
+func operatorCondition(columnName string, op string, v interface{}) (string, []interface{}, error) {
+	if sqlOp, ok := compareOperators[op]; ok {
+		if !isScalar(v) {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的 %s 操作只支持单值", columnName, op))
+		}
+		if v == nil && op == "eq" {
+			return fmt.Sprintf("%s is null", columnName), nil, nil
+		}
+		if v == nil && op == "ne" {
+			return fmt.Sprintf("%s is not null", columnName), nil, nil
+		}
+		return fmt.Sprintf("%s %s ?", columnName, sqlOp), []interface{}{v}, nil
+	}
+	switch op {
+	case "in", "notIn":
+		realValues, ok := v.([]interface{})
+		if !ok {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的 %s 操作必须为数组", columnName, op))
+		}
+		return inCondition(columnName, op, realValues)
+	case "isNull":
+		isNull, ok := v.(bool)
+		if !ok {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的 isNull 操作必须为布尔值", columnName))
+		}
+		if isNull {
+			return fmt.Sprintf("%s is null", columnName), nil, nil
+		}
+		return fmt.Sprintf("%s is not null", columnName), nil, nil
+	case "between":
+		realValues, ok := v.([]interface{})
+		if !ok || len(realValues) != 2 || !isScalar(realValues[0]) || !isScalar(realValues[1]) {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的 between 操作必须为两个值的数组", columnName))
+		}
+		return fmt.Sprintf("%s between ? and ?", columnName), realValues, nil
+	}
+	return "", nil, errors.New(fmt.Sprintf("参数错误, 不支持的操作符 %s", op))
+}
+
+// 构建in条件, 空数组时in条件恒假, notIn条件恒真
+func inCondition(columnName string, op string, realValues []interface{}) (string, []interface{}, error) {
+	for _, realValue := range realValues {
+		if !isScalar(realValue) {
+			return "", nil, errors.New(fmt.Sprintf("参数错误, %s 的 %s 操作只支持单值数组", columnName, op))
+		}
+	}
+	if len(realValues) <= 0 {
+		if op == "in" {
+			return "1 = 0", nil, nil
+		}
+		return "1 = 1", nil, nil
+	}
+	rangeStr := strings.TrimSuffix(strings.Repeat("?, ", len(realValues)), ", ")
+	if op == "in" {
+		return fmt.Sprintf("%s in (%s)", columnName, rangeStr), realValues, nil
+	}
+	return fmt.Sprintf("%s not in (%s)", columnName, rangeStr), realValues, nil
+}
+
+// 条件拼接
+func appendCondition(columnsStr string, condition string) string {
+	if len(condition) <= 0 {
+		return columnsStr
+	}
+	if len(columnsStr) > 0 {
+		return fmt.Sprintf("%s and %s", columnsStr, condition)
+	}
+	return condition
+}
+
+// 是否为单值参数
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return false
+	}
+	return true
+}
+
+// 参数名排序, 保证生成的sql稳定
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,160 @@
+package dbrest
+
+import (
+	"github.com/go-xorm/core"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"reflect"
+	"testing"
+)
+
+// 使用配置创建不连接数据库的mysql数据源, 只用于构建sql
+func testDbApi(t *testing.T, conf middleware.Config) *DbApi {
+	t.Helper()
+	stateLock.Lock()
+	old := loadState().config
+	updateState(func(s *runtimeState) {
+		s.config = conf
+	})
+	stateLock.Unlock()
+	t.Cleanup(func() {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		updateState(func(s *runtimeState) {
+			s.config = old
+		})
+	})
+	orm, err := xorm.NewEngine(DriverMysql, "user:password@tcp(127.0.0.1:3306)/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = orm.Close()
+	})
+	return &DbApi{orm: orm}
+}
+
+// 测试表 user
+func testTable() core.Table {
+	table := core.NewEmptyTable()
+	table.Name = "user"
+	for _, name := range []string{"id", "name", "age", "password"} {
+		table.AddColumn(core.NewColumn(name, "", core.SQLType{Name: core.Varchar}, 0, 0, true))
+	}
+	return *table
+}
+
+// 条件构建用例
+type conditionCase struct {
+	name   string
+	filter map[string]interface{}
+	sql    string
+	values []interface{}
+	ok     bool
+}
+
+func runConditionCases(t *testing.T, resolve columnResolver, strict bool, cases []conditionCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sql, values, err := filterCondition(resolve, c.filter, strict)
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("期望返回错误, 实际 %s %v", sql, values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != c.sql || !reflect.DeepEqual(values, c.values) {
+				t.Fatalf("期望 %s %v, 实际 %s %v", c.sql, c.values, sql, values)
+			}
+		})
+	}
+}
+
+func TestOperatorCondition(t *testing.T) {
+	dbApi := testDbApi(t, middleware.Config{})
+	runConditionCases(t, tableColumns(dbApi, testTable()), false, []conditionCase{
+		{"eq", map[string]interface{}{"age": 18.0}, "`age` = ?", []interface{}{18.0}, true},
+		{"range", map[string]interface{}{"age": map[string]interface{}{"gte": 18.0, "lt": 65.0}},
+			"`age` >= ? and `age` < ?", []interface{}{18.0, 65.0}, true},
+		{"like", map[string]interface{}{"name": map[string]interface{}{"like": "a%"}},
+			"`name` like ?", []interface{}{"a%"}, true},
+		{"eq null", map[string]interface{}{"name": map[string]interface{}{"eq": nil}}, "`name` is null", nil, true},
+		{"ne null", map[string]interface{}{"name": map[string]interface{}{"ne": nil}}, "`name` is not null", nil, true},
+		{"isNull", map[string]interface{}{"name": map[string]interface{}{"isNull": false}}, "`name` is not null", nil, true},
+		{"isNull not bool", map[string]interface{}{"name": map[string]interface{}{"isNull": "true"}}, "", nil, false},
+		{"compare array", map[string]interface{}{"age": map[string]interface{}{"gt": []interface{}{1.0}}}, "", nil, false},
+		{"unknown operator", map[string]interface{}{"age": map[string]interface{}{"regexp": ".*"}}, "", nil, false},
+		{"injected operator", map[string]interface{}{"age": map[string]interface{}{"= 1 or 1": 1.0}}, "", nil, false},
+		{"between", map[string]interface{}{"age": map[string]interface{}{"between": []interface{}{18.0, 65.0}}},
+			"`age` between ? and ?", []interface{}{18.0, 65.0}, true},
+		{"between one value", map[string]interface{}{"age": map[string]interface{}{"between": []interface{}{18.0}}}, "", nil, false},
+		{"between three values", map[string]interface{}{"age": map[string]interface{}{"between": []interface{}{1.0, 2.0, 3.0}}}, "", nil, false},
+		{"between not array", map[string]interface{}{"age": map[string]interface{}{"between": 18.0}}, "", nil, false},
+		{"between nested", map[string]interface{}{"age": map[string]interface{}{"between": []interface{}{[]interface{}{1.0}, 2.0}}}, "", nil, false},
+		{"unknown column ignored", map[string]interface{}{"nickname": "a", "age": 1.0}, "`age` = ?", []interface{}{1.0}, true},
+	})
+}
+
+func TestInCondition(t *testing.T) {
+	dbApi := testDbApi(t, middleware.Config{})
+	runConditionCases(t, tableColumns(dbApi, testTable()), false, []conditionCase{
+		{"array", map[string]interface{}{"id": []interface{}{1.0, 2.0}}, "`id` in (?, ?)", []interface{}{1.0, 2.0}, true},
+		{"in", map[string]interface{}{"id": map[string]interface{}{"in": []interface{}{1.0}}}, "`id` in (?)", []interface{}{1.0}, true},
+		{"notIn", map[string]interface{}{"id": map[string]interface{}{"notIn": []interface{}{1.0, 2.0}}},
+			"`id` not in (?, ?)", []interface{}{1.0, 2.0}, true},
+		{"empty array", map[string]interface{}{"id": []interface{}{}}, "1 = 0", nil, true},
+		{"empty in", map[string]interface{}{"id": map[string]interface{}{"in": []interface{}{}}}, "1 = 0", nil, true},
+		{"empty notIn", map[string]interface{}{"id": map[string]interface{}{"notIn": []interface{}{}}}, "1 = 1", nil, true},
+		{"in not array", map[string]interface{}{"id": map[string]interface{}{"in": 1.0}}, "", nil, false},
+		{"nested array", map[string]interface{}{"id": []interface{}{[]interface{}{1.0}}}, "", nil, false},
+		{"object element", map[string]interface{}{"id": map[string]interface{}{"notIn": []interface{}{map[string]interface{}{}}}}, "", nil, false},
+	})
+}
+
+func TestStrictColumns(t *testing.T) {
+	dbApi := testDbApi(t, middleware.Config{"db.table.user.hiddenColumns": "password"})
+	resolve := tableColumns(dbApi, testTable())
+	runConditionCases(t, resolve, true, []conditionCase{
+		{"known column", map[string]interface{}{"name": "a"}, "`name` = ?", []interface{}{"a"}, true},
+		{"unknown column", map[string]interface{}{"nickname": "a"}, "", nil, false},
+		{"hidden column", map[string]interface{}{"password": "a"}, "", nil, false},
+		{"hidden column case", map[string]interface{}{"PASSWORD": "a"}, "", nil, false},
+		{"injected column", map[string]interface{}{"1 = 1 or name": "a"}, "", nil, false},
+	})
+	// 非严格模式下隐藏列同样不作为条件
+	runConditionCases(t, resolve, false, []conditionCase{
+		{"hidden column ignored", map[string]interface{}{"password": "a"}, "", nil, true},
+	})
+}
+
+func TestGroupCondition(t *testing.T) {
+	dbApi := testDbApi(t, middleware.Config{"db.table.user.hiddenColumns": "password"})
+	runConditionCases(t, tableColumns(dbApi, testTable()), false, []conditionCase{
+		{"or", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"age": 1.0}, map[string]interface{}{"name": "a"}}},
+			"((`age` = ?) or (`name` = ?))", []interface{}{1.0, "a"}, true},
+		{"and", map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"age": map[string]interface{}{"gte": 1.0}}, map[string]interface{}{"age": map[string]interface{}{"lt": 9.0}}}},
+			"((`age` >= ?) and (`age` < ?))", []interface{}{1.0, 9.0}, true},
+		{"not", map[string]interface{}{"$not": map[string]interface{}{"name": "a"}}, "not (`name` = ?)", []interface{}{"a"}, true},
+		{"nested", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"$not": map[string]interface{}{"age": 1.0}}, map[string]interface{}{"name": "a"}}},
+			"((not (`age` = ?)) or (`name` = ?))", []interface{}{1.0, "a"}, true},
+		{"empty or", map[string]interface{}{"$or": []interface{}{}}, "1 = 0", nil, true},
+		{"empty and", map[string]interface{}{"$and": []interface{}{}}, "", nil, true},
+		{"empty not", map[string]interface{}{"$not": map[string]interface{}{}}, "not (1 = 1)", nil, true},
+		{"empty element", map[string]interface{}{"$or": []interface{}{map[string]interface{}{}}}, "((1 = 1))", nil, true},
+		{"or not array", map[string]interface{}{"$or": map[string]interface{}{"age": 1.0}}, "", nil, false},
+		{"or element not object", map[string]interface{}{"$or": []interface{}{"age"}}, "", nil, false},
+		{"not not object", map[string]interface{}{"$not": []interface{}{}}, "", nil, false},
+		// 条件组中必须使用存在的列
+		{"unknown column in group", map[string]interface{}{"$or": []interface{}{map[string]interface{}{"nickname": "a"}}}, "", nil, false},
+		{"hidden column in group", map[string]interface{}{"$not": map[string]interface{}{"password": "a"}}, "", nil, false},
+		{"unknown operator in group", map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"age": map[string]interface{}{"regexp": ".*"}}}}, "", nil, false},
+	})
+}
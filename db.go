@@ -36,6 +36,7 @@ import (
 )
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-xorm/core"
 	"github.com/go-xorm/xorm"
@@ -45,6 +46,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var Logger = middleware.GetLogger("dbrest")
@@ -56,6 +58,8 @@ type TableHandler struct {
 }
 
 type DbApi struct {
+	name       string
+	driver     string
 	host       string
 	port       int
 	user       string
@@ -64,70 +68,106 @@ type DbApi struct {
 	datasource string
 	orm        *xorm.Engine
 	dataStruct map[string]reflect.Type
+	tables     []*core.Table
+	// 不带时区的时间值使用的时区
+	loc        *time.Location
+	tableMetas map[string]core.Table
+	// 表结构, 重新加载时整体替换, dataStruct 同样使用 metaLock
+	metaLock   sync.RWMutex
+	reloadLock sync.Mutex
+	reloadDone chan struct{}
+	// 从库
+	replicas    []*replica
+	replicaNext uint32
+	replicaDone chan struct{}
 }
 
-var dbApiInstance *DbApi
-
-var dbApiInstanceLock = new(sync.Mutex)
-
-func newXormHandler(host string,
+func newXormHandler(name string,
+	driver string,
+	host string,
 	port int,
 	user string,
 	password string,
 	db string) (*DbApi, error) {
 	res := &DbApi{
+		name:       name,
+		driver:     driver,
 		host:       host,
 		port:       port,
 		user:       user,
 		password:   password,
 		db:         db,
 		dataStruct: make(map[string]reflect.Type),
+		loc:        datasourceLocation(name),
+	}
+	datasource, err := dataSourceName(res.name, res.driver, res.host, res.port, res.user, res.password, res.db)
+	if err != nil {
+		Logger.ErrorF("数据库配置错误 %s", err.Error())
+		return nil, err
+	}
+	res.datasource = datasource
+	if !driverRegistered(res.driver) {
+		err = errors.New(fmt.Sprintf("数据库驱动 %s 未注册, 需使用对应的 -tags 编译或导入驱动", res.driver))
+		Logger.ErrorF("数据库配置错误 %s", err.Error())
+		return nil, err
 	}
-	res.datasource = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8",
-		res.user, res.password, res.host, res.port, res.db)
-	orm, err := xorm.NewEngine("mysql", res.datasource)
-	// orm, err := xorm.NewEngine("sqlite3", "data.db")
+	orm, err := xorm.NewEngine(res.driver, res.datasource)
 	if err != nil {
 		Logger.ErrorF("数据库连接错误 %s", err.Error())
 		return nil, err
 	}
 	orm.ShowSQL(true)
-	if res.orm != nil {
-		_ = res.orm.Close()
+	if err = configurePool(res.name, orm); err != nil {
+		Logger.ErrorF("连接池配置错误 %s", err.Error())
+		_ = orm.Close()
+		return nil, err
 	}
 	res.orm = orm
 	return res, nil
 }
 
-func initEngine() {
-
-	dbApiInstanceLock.Lock()
-	defer dbApiInstanceLock.Unlock()
-
-	var err error
-
+// 根据配置创建数据源, 默认数据源使用 db.host 等配置, 命名数据源使用 db.<name>.host 等配置
+func newDbApi(name string) (*DbApi, error) {
+	driver := dbDriver(name)
 	// 类型判断
 	// var port int
-	port, err := middleware.ConfInt(Config, "db.port")
-	if err != nil {
-		Logger.ErrorF("配置文件端口数据类型错误, 使用默认端口60888: %v", middleware.ConfPrint(Config))
+	port, err := middleware.ConfInt(dbConfig(), datasourceKey(name, "port"))
+	if err != nil && driver != DriverSqlite {
+		Logger.ErrorF("配置文件端口数据类型错误, 使用默认端口60888: %v", middleware.ConfPrint(dbConfig()))
 		port = 60888
 	}
 
-	dbApiInstance, err = newXormHandler(
-		middleware.ConfUnsafe(Config, "db.host"),
+	dbApi, err := newXormHandler(
+		name,
+		driver,
+		middleware.ConfUnsafe(dbConfig(), datasourceKey(name, "host")),
 		port,
-		middleware.ConfUnsafe(Config, "db.user"),
-		middleware.ConfUnsafe(Config, "db.password"),
-		middleware.ConfUnsafe(Config, "db.database"))
+		middleware.ConfUnsafe(dbConfig(), datasourceKey(name, "user")),
+		middleware.ConfUnsafe(dbConfig(), datasourceKey(name, "password")),
+		middleware.ConfUnsafe(dbConfig(), datasourceKey(name, "database")))
+	if err != nil {
+		return nil, err
+	}
+	dbApi.initReplicas()
+	return dbApi, nil
+}
 
-	if middleware.ProcessError(err) {
-		return
+// 数据源配置名
+func datasourceKey(name string, key string) string {
+	if len(name) <= 0 {
+		return fmt.Sprintf("db.%s", key)
 	}
-	dbApiInstance.GetEngine().ShowSQL(true)
+	return fmt.Sprintf("db.%s.%s", name, key)
+}
+
+// 获取数据源配置
+func datasourceConf(name string, key string) string {
+	return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), datasourceKey(name, key)))
 }
 
 func (this *DbApi) GetStruct() map[string]map[string]string {
+	this.metaLock.RLock()
+	defer this.metaLock.RUnlock()
 	res := make(map[string]map[string]string)
 	for table, st := range this.dataStruct {
 		columnStruct := make(map[string]string)
@@ -141,7 +181,30 @@ func (this *DbApi) GetStruct() map[string]map[string]string {
 }
 
 func (this *DbApi) GetMeta(tableName string) core.Table {
-	return tableMetas[tableName]
+	tableMeta, _ := this.lookupMeta(tableName)
+	return tableMeta
+}
+
+// 停止数据源的后台任务
+func (this *DbApi) stop() {
+	this.stopReplicas()
+	this.stopSchemaReload()
+}
+
+// 数据源名称, 默认数据源为空
+func (this *DbApi) Name() string {
+	return this.name
+}
+
+// 接口路径, 命名数据源时增加数据源名称前缀
+func (this *DbApi) path(path string) string {
+	if len(this.name) <= 0 {
+		return path
+	}
+	if strings.HasPrefix(path, "/") {
+		return fmt.Sprintf("/%s%s", this.name, path)
+	}
+	return fmt.Sprintf("%s/%s", this.name, path)
 }
 
 func (this *DbApi) GetEngine() *xorm.Engine {
@@ -150,12 +213,26 @@ func (this *DbApi) GetEngine() *xorm.Engine {
 
 // 获取
 func GetMeta(tableName string) core.Table {
-	return dbApiInstance.GetMeta(tableName)
+	return GetDbApi("").GetMeta(tableName)
+}
+
+// 获取默认数据源的所有表结构
+func GetTables() []*core.Table {
+	return GetDbApi("").GetTables()
 }
 
 // 获取数据库引擎
 func GetEngine() *xorm.Engine {
-	return dbApiInstance.GetEngine()
+	return GetDbApi("").GetEngine()
+}
+
+// 获取数据源, 名称为空时返回默认数据源, 不存在时返回nil
+func GetDbApi(name string) *DbApi {
+	s := loadState()
+	if len(name) <= 0 {
+		return s.dbApi
+	}
+	return s.dbApis[name]
 }
 
 func (this *DbApi) RegisterDbApi(orm interface{}) {
@@ -167,7 +244,12 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 	ormType := ormValue.Elem().Type()
 	Logger.InfoLn("开始注册 : ", orm.(xorm.TableName).TableName())
 	Logger.InfoLn("%#v\n", orm)
+	// 与重新初始化互斥, 新的数据源沿用已注册的结构体
+	stateLock.Lock()
+	this.metaLock.Lock()
 	this.dataStruct[orm.(xorm.TableName).TableName()] = ormType
+	this.metaLock.Unlock()
+	stateLock.Unlock()
 	primaryIndex := -1
 	for i := 0; i < ormType.NumField(); i++ {
 		tag := ormType.Field(i).Tag.Get("xorm")
@@ -183,10 +265,11 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 	if !isExist {
 		_ = this.orm.CreateTables(orm)
 	}
+	tableName := orm.(xorm.TableName).TableName()
 
-	middleware.RegisterHandler(fmt.Sprintf("/%s/insert", orm.(xorm.TableName).TableName()),
-		func(ctx middleware.Context) {
-			resValue := reflect.New(ormType) // INSERT INTO .. ON DUPLICATE KEY UPDATE
+	registerDatasourceRoute(this, fmt.Sprintf("/%s/insert", tableName),
+		func(ctx middleware.Context, dbApi *DbApi) {
+			resValue := reflect.New(ormType)
 			err := json.Unmarshal(ctx.GetBody(), resValue.Interface())
 			if err != nil {
 				Logger.InfoLn(err.Error())
@@ -194,7 +277,36 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 				return
 			}
 			Logger.InfoF("%#v", resValue.Interface())
-			_, err = this.orm.Insert(resValue.Interface())
+			err = dbApi.beanTransaction(func(session *xorm.Session) error {
+				if _, err := session.Insert(resValue.Interface()); err != nil {
+					return err
+				}
+				return writeAuditLog(*session, tableName, Insert, dbApi.beanPK(resValue.Interface()),
+					nil, resValue.Interface(), requestParams(ctx))
+			})
+			if err != nil {
+				Logger.InfoLn(err.Error())
+				_ = ctx.ApiResponse(-1, "", nil)
+				return
+			}
+			_ = ctx.ApiResponse(0, "", nil)
+			return
+		})
+
+	// 主键存在时更新, 否则插入
+	registerDatasourceRoute(this, fmt.Sprintf("/%s/upsert", tableName),
+		func(ctx middleware.Context, dbApi *DbApi) {
+			resValue := reflect.New(ormType)
+			err := json.Unmarshal(ctx.GetBody(), resValue.Interface())
+			if err != nil {
+				Logger.InfoLn(err.Error())
+				_ = ctx.ApiResponse(-1, "", nil)
+				return
+			}
+			// 审计记录由 upsertRow 写入
+			err = dbApi.beanTransaction(func(session *xorm.Session) error {
+				return dbApi.upsertBean(session, resValue.Interface(), requestParams(ctx))
+			})
 			if err != nil {
 				Logger.InfoLn(err.Error())
 				_ = ctx.ApiResponse(-1, "", nil)
@@ -204,8 +316,8 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 			return
 		})
 
-	middleware.RegisterHandler(fmt.Sprintf("/%s/update", orm.(xorm.TableName).TableName()),
-		func(ctx middleware.Context) {
+	registerDatasourceRoute(this, fmt.Sprintf("/%s/update", tableName),
+		func(ctx middleware.Context, dbApi *DbApi) {
 			resValue := reflect.New(ormType)
 			err := json.Unmarshal(ctx.GetBody(), resValue.Interface())
 			if err != nil {
@@ -213,9 +325,52 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 				_ = ctx.ApiResponse(-1, "", nil)
 				return
 			}
-			condition := make(map[string]int)
-			condition["id"], _ = strconv.Atoi(ctx.Request.URL.Query().Get("id"))
-			_, err = this.orm.Update(resValue.Interface(), condition)
+			id, _ := strconv.Atoi(ctx.Request.URL.Query().Get("id"))
+			// xorm 条件只支持 map[string]interface{} 或结构体
+			condition := map[string]interface{}{"id": id}
+			// xorm version 标签乐观锁, 必须指定当前版本
+			versionColumn := dbApi.orm.TableInfo(resValue.Interface()).VersionColumn()
+			if versionColumn != nil {
+				field := resValue.Elem().FieldByName(versionColumn.FieldName)
+				if !field.IsValid() || reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+					_ = ctx.ApiResponse(-1, fmt.Sprintf("参数错误, 没有版本 %s", versionColumn.Name), nil)
+					return
+				}
+			}
+			pk := core.PK{id}
+			err = dbApi.beanTransaction(func(session *xorm.Session) error {
+				before, err := dbApi.beanImage(session, ormType, pk)
+				if err != nil {
+					return err
+				}
+				rowsAffected, err := session.Update(resValue.Interface(), condition)
+				if err != nil {
+					return err
+				}
+				if versionColumn != nil && rowsAffected <= 0 {
+					// 未更新数据时区分数据不存在与版本冲突
+					exist, err := session.ID(pk).Get(reflect.New(ormType).Interface())
+					if err != nil {
+						return err
+					}
+					if !exist {
+						return ErrNotFound
+					}
+					return ErrVersionConflict
+				}
+				if rowsAffected <= 0 {
+					return nil
+				}
+				after, err := dbApi.beanImage(session, ormType, pk)
+				if err != nil {
+					return err
+				}
+				return writeAuditLog(*session, tableName, Update, pk, before, after, requestParams(ctx))
+			})
+			if err == ErrVersionConflict || err == ErrNotFound {
+				_ = ctx.ApiResponse(errorCode(err), err.Error(), nil)
+				return
+			}
 			if err != nil {
 				Logger.InfoLn(err.Error())
 				_ = ctx.ApiResponse(-1, "", nil)
@@ -225,10 +380,20 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 			return
 		})
 
-	middleware.RegisterHandler(fmt.Sprintf("/%s/delete", orm.(xorm.TableName).TableName()),
-		func(ctx middleware.Context) {
+	registerDatasourceRoute(this, fmt.Sprintf("/%s/delete", tableName),
+		func(ctx middleware.Context, dbApi *DbApi) {
 			id, _ := strconv.Atoi(ctx.Request.URL.Query().Get("id"))
-			_, err := this.orm.Delete(map[string]interface{}{"id": id})
+			err := dbApi.beanTransaction(func(session *xorm.Session) error {
+				before, err := dbApi.beanImage(session, ormType, core.PK{id})
+				if err != nil {
+					return err
+				}
+				rowsAffected, err := session.Delete(map[string]interface{}{"id": id})
+				if err != nil || rowsAffected <= 0 {
+					return err
+				}
+				return writeAuditLog(*session, tableName, Delete, core.PK{id}, before, nil, requestParams(ctx))
+			})
 			if err != nil {
 				Logger.InfoLn(err.Error())
 				_ = ctx.ApiResponse(-1, "", nil)
@@ -238,8 +403,8 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 			return
 		})
 
-	middleware.RegisterHandler(fmt.Sprintf("/%s/select", orm.(xorm.TableName).TableName()),
-		func(ctx middleware.Context) {
+	registerDatasourceRoute(this, fmt.Sprintf("/%s/select", tableName),
+		func(ctx middleware.Context, dbApi *DbApi) {
 			resValue := reflect.New(ormType)
 			err := json.Unmarshal(ctx.GetBody(), resValue.Interface())
 			if err != nil {
@@ -247,8 +412,17 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 				_ = ctx.ApiResponse(-1, "", nil)
 				return
 			}
+			params := make(map[string]interface{})
+			_ = json.Unmarshal(ctx.GetBody(), &params)
+			session, err := dbApi.selectSession(ctx, resValue.Interface(), params)
+			if err != nil {
+				Logger.InfoLn(err.Error())
+				_ = ctx.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			defer session.Close()
 			res := reflect.New(reflect.SliceOf(ormType)).Interface()
-			err = this.orm.Find(res, resValue.Interface())
+			err = session.Find(res, resValue.Interface())
 			if err != nil {
 				Logger.InfoLn(err.Error())
 				_ = ctx.ApiResponse(-1, "", nil)
@@ -259,6 +433,131 @@ func (this *DbApi) RegisterDbApi(orm interface{}) {
 		})
 }
 
+// 沿用原数据源注册的结构体, 重新初始化后结构体接口继续可用
+func (this *DbApi) inheritStructs(old *DbApi) {
+	if old == nil {
+		return
+	}
+	old.metaLock.RLock()
+	defer old.metaLock.RUnlock()
+	this.metaLock.Lock()
+	defer this.metaLock.Unlock()
+	for tableName, ormType := range old.dataStruct {
+		this.dataStruct[tableName] = ormType
+	}
+}
+
+// 在事务中执行结构体操作, 出错时回滚
+func (this *DbApi) beanTransaction(action func(session *xorm.Session) error) error {
+	session := this.orm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if err := action(session); err != nil {
+		_ = session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+// 按主键查询结构体数据镜像, 未开启审计或数据不存在时返回nil
+func (this *DbApi) beanImage(session *xorm.Session, ormType reflect.Type, pk core.PK) (interface{}, error) {
+	if !auditEnabled() || pk == nil {
+		return nil, nil
+	}
+	bean := reflect.New(ormType).Interface()
+	has, err := session.ID(pk).Get(bean)
+	if err != nil || !has {
+		return nil, err
+	}
+	return bean, nil
+}
+
+// 插入或更新结构体数据
+//
+// 使用结构体的表结构生成与通用接口相同的 upsert 语句, 避免先查询再写入时并发插入主键冲突
+func (this *DbApi) upsertBean(session *xorm.Session, bean interface{}, confParams map[string]string) error {
+	tableInfo := this.orm.TableInfo(bean)
+	beanValue := reflect.Indirect(reflect.ValueOf(bean))
+	row := make(map[string]interface{})
+	for _, column := range tableInfo.Columns() {
+		field := beanValue.FieldByName(column.FieldName)
+		if !field.IsValid() {
+			continue
+		}
+		// 未赋值的自增主键由数据库生成
+		if column.IsAutoIncrement && reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+			continue
+		}
+		value := field.Interface()
+		if column.IsJSON {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			value = string(data)
+		}
+		row[column.Name] = value
+	}
+	_, err := upsertRow(*session, this, *tableInfo.Table, row, confParams)
+	return err
+}
+
+// 获取结构体主键值, 主键未赋值时返回nil
+func (this *DbApi) beanPK(bean interface{}) core.PK {
+	tableInfo := this.orm.TableInfo(bean)
+	beanValue := reflect.Indirect(reflect.ValueOf(bean))
+	pkColumns := tableInfo.PKColumns()
+	if len(pkColumns) <= 0 {
+		return nil
+	}
+	pk := make(core.PK, 0, len(pkColumns))
+	for _, column := range pkColumns {
+		field := beanValue.FieldByName(column.FieldName)
+		if !field.IsValid() || reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+			return nil
+		}
+		pk = append(pk, field.Interface())
+	}
+	return pk
+}
+
+// 根据 fields, exclude 参数创建查询会话, 优先使用从库
+func (this *DbApi) selectSession(ctx middleware.Context, bean interface{},
+	params map[string]interface{}) (*xorm.Session, error) {
+
+	tableInfo := this.orm.TableInfo(bean)
+	fields, err := columnNames(this, *tableInfo.Table, "fields", params["fields"])
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := columnNames(this, *tableInfo.Table, "exclude", params["exclude"])
+	if err != nil {
+		return nil, err
+	}
+	// 隐藏列不返回, 结构体中的隐藏列置空, 不作为查询条件
+	hidden := this.hiddenColumns(tableInfo.Table.Name)
+	beanValue := reflect.Indirect(reflect.ValueOf(bean))
+	for _, column := range tableInfo.Table.Columns() {
+		if !hidden[strings.ToLower(column.Name)] {
+			continue
+		}
+		exclude = append(exclude, column.Name)
+		if field := beanValue.FieldByName(column.FieldName); field.IsValid() && field.CanSet() {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	session := this.readSession(consistentRead(ctx, params))
+	if len(fields) > 0 {
+		session = session.Cols(fields...)
+	}
+	if len(exclude) > 0 {
+		session = session.Omit(exclude...)
+	}
+	return session, nil
+}
+
 var reg, _ = regexp.Compile("\\$\\{(.*?)\\}")
 var idReg, _ = regexp.Compile("(\\d+)\\.id")
 
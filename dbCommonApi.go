@@ -2,16 +2,29 @@ package dbrest
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/go-xorm/core"
+	"github.com/go-xorm/xorm"
 	"github.com/wenlaizhou/middleware"
+	"net/http"
 	"strings"
 )
 
-var Tables []*core.Table
+// 接口返回码
+const (
+	CodeUnauthorized = -401 // 未认证
+	CodeForbidden    = -403 // 操作不允许
+	CodeNotFound     = -404 // 数据不存在
+	CodeConflict     = -409 // 数据版本冲突
+)
 
-var tableMetas map[string]core.Table
+// 默认数据源的表, 调用 InitDbApi 及重新加载表结构时更新
+//
+// Deprecated: 更新时没有同步, 不能在服务运行中读取, 使用 GetTables 获取
+var Tables []*core.Table
 
+// 调用 InitDbApi 时的配置
+//
+// Deprecated: 更新时没有同步, 不能在服务运行中读取, 使用 GetConfig 获取
 var Config middleware.Config
 
 var inited = false
@@ -22,38 +35,156 @@ var inited = false
 //
 // 配置:
 // {
+// 	"db.driver" : "mysql",
 // 	"db.host" : "",
 // 	"db.port" : 3306,
 // 	"db.user" : "",
 // 	"db.password" : "",
-// 	"db.database" : ""
+// 	"db.database" : "",
+// 	"db.maxPageSize" : 1000,
+// 	"db.batchSize" : 100,
+// 	"db.maxAffectedRows" : 1000,
+// 	"db.sqlApi" : true,
+// 	"db.typedResult" : true,
+// 	"db.versionColumn" : "version",
+// 	"db.audit.createdBy" : "created_by",
+// 	"db.audit.updatedBy" : "updated_by",
+// 	"db.auditLog" : false,
+// 	"db.auditLog.table" : "dbrest_audit_log",
+// 	"db.replicas" : "10.0.0.2:3306, 10.0.0.3:3306",
+// 	"db.replicaCheckInterval" : 10,
+// 	"db.schemaReloadInterval" : 60,
+// 	"db.maxOpenConns" : 100,
+// 	"db.maxIdleConns" : 10,
+// 	"db.connMaxLifetime" : "30m",
+// 	"db.utf8mb4" : true,
+// 	"db.parseTime" : true,
+// 	"db.loc" : "Local",
+// 	"db.timeout" : "5s",
+// 	"db.tls" : "true",
+// 	"db.params" : "interpolateParams=true"
 // }
+//
+// db.driver 支持 mysql, postgres, sqlite3, sqlite3 使用 db.database 作为数据库文件路径
+//
+// 多数据源:
+// {
+// 	"db.datasources" : "orders, users",
+// 	"db.orders.driver" : "postgres",
+// 	"db.orders.host" : "",
+// 	...
+// }
+//
+// 查询优先使用从库, 请求参数 "consistent" : true 时查询主库
+//
+// 命名数据源的接口增加数据源名称前缀, 例如 /orders/<table>/select, /orders/tables, /orders/sql
+//
+// 重新加载表结构接口 /reload, 配置 db.schemaReloadInterval 时定时重新加载, 新增的表自动注册接口
+//
+// 连接池状态接口 /pool, 连接及数据源参数见 configurePool, dataSourceName
+//
+// 审计列配置见 auditPolicy, 表及列的访问控制见 tableExposed, 认证见 configAuthenticator, SetAuthenticator
+//
+// 服务运行中重新调用时, 新的数据源创建完成后整体替换, 原数据源延迟关闭, 创建失败的数据源保留原数据源
 func InitDbApi(conf middleware.Config) {
 
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
 	Config = conf
-	initEngine()
-	tablesMeta, err := dbApiInstance.GetEngine().DBMetas()
+	updateState(func(s *runtimeState) {
+		s.config = conf
+	})
+	// 配置 db.auth 时使用内置认证, 配置错误时拒绝所有请求,
+	// 删除 db.auth 后清除由配置创建的认证, SetAuthenticator 设置的认证保留
+	authenticator, err := configAuthenticator()
 	if middleware.ProcessError(err) {
-		return
+		authenticator = deniedAuthenticator{err: err}
 	}
+	updateState(func(s *runtimeState) {
+		if authenticator != nil {
+			s.authenticator = authenticator
+			s.authFromConfig = true
+		} else if s.authFromConfig {
+			s.authenticator = nil
+			s.authFromConfig = false
+		}
+	})
 
-	tableMetas = make(map[string]core.Table)
-
-	Tables = make([]*core.Table, 0)
+	names := []string{""}
+	configured := make(map[string]bool)
+	for _, name := range strings.Split(middleware.ConfUnsafe(dbConfig(), "db.datasources"), ",") {
+		name = strings.TrimSpace(name)
+		if len(name) <= 0 {
+			continue
+		}
+		names = append(names, name)
+		configured[name] = true
+	}
+	created := make(map[string]*DbApi)
+	for _, name := range names {
+		dbApi, err := newDbApi(name)
+		if err == nil {
+			dbApi.inheritStructs(GetDbApi(name))
+			if err = registerDatasource(dbApi); err != nil {
+				dbApi.retire()
+			}
+		}
+		if middleware.ProcessError(err) {
+			Logger.ErrorF("数据源 %s 初始化失败", name)
+			continue
+		}
+		created[name] = dbApi
+	}
 
-	for _, tableMeta := range tablesMeta {
-		tableMeta := tableMeta
-		Tables = append(Tables, tableMeta)
-		tableMetas[tableMeta.Name] = *tableMeta
-		registerTableCommonApi(*tableMeta)
+	old := loadState()
+	updateState(func(s *runtimeState) {
+		for name, dbApi := range created {
+			if len(name) <= 0 {
+				s.dbApi = dbApi
+			} else {
+				s.dbApis[name] = dbApi
+			}
+		}
+		// 删除不再配置的命名数据源
+		for name := range s.dbApis {
+			if !configured[name] {
+				delete(s.dbApis, name)
+			}
+		}
+	})
+	if _, ok := created[""]; ok && old.dbApi != nil {
+		old.dbApi.retire()
 	}
-	registerTables()
-	if middleware.ProcessError(err) {
-		return
+	for name, dbApi := range old.dbApis {
+		if _, ok := created[name]; ok || !configured[name] {
+			dbApi.retire()
+		}
 	}
-	// 注册sql接口
-	middleware.RegisterHandler(fmt.Sprintf("/sql"),
-		func(context middleware.Context) { // 安全
+	if dbApi := GetDbApi(""); dbApi != nil {
+		Tables = dbApi.GetTables()
+	}
+}
+
+// 加载数据源的表结构, 注册通用接口
+//
+// 接口处理时使用当前的数据源, 数据源替换前的请求仍由原数据源处理
+func registerDatasource(dbApi *DbApi) error {
+	initAuditLog(dbApi)
+	if _, err := dbApi.reloadSchema(); err != nil {
+		return err
+	}
+	registerTables(dbApi)
+	registerPoolStats(dbApi)
+	registerSchemaReload(dbApi)
+	dbApi.startSchemaReload()
+	// 注册sql接口, 处理时检查是否关闭
+	registerDatasourceRoute(dbApi, "/sql",
+		func(context middleware.Context, dbApi *DbApi) { // 安全
+			if !sqlApiEnabled() {
+				_ = context.ApiResponse(CodeForbidden, "sql接口已关闭", nil)
+				return
+			}
 			jsonParam, err := context.GetJSON()
 			if middleware.ProcessError(err) {
 				_ = context.ApiResponse(-1, "参数错误", nil)
@@ -83,7 +214,10 @@ func InitDbApi(conf middleware.Config) {
 			}
 
 			logSql(context, sqlStr, nil)
-			res, err := dbApiInstance.GetEngine().QueryString(sqlStr)
+			// 只读sql优先使用从库
+			engine := dbApi.readEngine(!isReadSql(sqlStr) || consistentRead(context, jsonParam))
+			// 没有表结构, 根据结果集的列类型转换结果
+			res, err := queryResultRows(engine.DB().DB, dbApi.loc, sqlStr)
 			if !middleware.ProcessError(err) {
 				Logger.InfoF("%s\n, %s\n, %s\n",
 					context.RemoteAddr(),
@@ -95,39 +229,92 @@ func InitDbApi(conf middleware.Config) {
 			}
 
 		})
+	return nil
+}
+
+// sql接口是否开启, db.sqlApi 配置为false时关闭
+func sqlApiEnabled() bool {
+	return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.sqlApi")) != "false"
 }
 
-func registerTables() {
-	middleware.RegisterHandler("/tables", func(context middleware.Context) {
-		tablesBytes, _ := json.Marshal(Tables)
+func registerTables(dbApi *DbApi) {
+	registerDatasourceRoute(dbApi, "/tables", func(context middleware.Context, dbApi *DbApi) {
+		tables := make([]core.Table, 0)
+		for _, table := range dbApi.GetTables() {
+			if dbApi.tableExposed(table.Name) {
+				tables = append(tables, dbApi.visibleTable(*table))
+			}
+		}
+		tablesBytes, _ := json.Marshal(tables)
 		tablesResult := string(tablesBytes)
 		_ = context.JSON(tablesResult)
 		return
 	})
 }
 
-func registerTableCommonApi(tableMeta core.Table) {
-	registerTableInsert(tableMeta)
-	registerTableUpdate(tableMeta)
-	registerTableSelect(tableMeta)
-	registerTableDelete(tableMeta)
-	registerTableCount(tableMeta)
-	registerTableSchema(tableMeta)
+func registerTableCommonApi(dbApi *DbApi, tableName string) {
+	registerTableInsert(dbApi, tableName)
+	registerTableBatchInsert(dbApi, tableName)
+	registerTableUpsert(dbApi, tableName)
+	registerTableUpdate(dbApi, tableName)
+	registerTableUpdateWhere(dbApi, tableName)
+	registerTableSelect(dbApi, tableName)
+	registerTableGet(dbApi, tableName)
+	registerTableDelete(dbApi, tableName)
+	registerTableDeleteWhere(dbApi, tableName)
+	registerTableRestore(dbApi, tableName)
+	registerTableCount(dbApi, tableName)
+	registerTableAggregate(dbApi, tableName)
+	registerTableSchema(dbApi, tableName)
+}
+
+// 根据错误获取返回码
+func errorCode(err error) int {
+	switch err {
+	case ErrNotFound:
+		return CodeNotFound
+	case ErrVersionConflict:
+		return CodeConflict
+	case ErrUnauthorized:
+		return CodeUnauthorized
+	}
+	return -1
+}
+
+// 在事务中执行操作, 出错时回滚
+func (this *DbApi) transaction(action func(session xorm.Session) (interface{}, error)) (interface{}, error) {
+	session := this.GetEngine().NewSession()
+	defer session.Close()
+	if err := session.Begin(); middleware.ProcessError(err) {
+		return nil, err
+	}
+	res, err := action(*session)
+	if err != nil {
+		middleware.ProcessError(session.Rollback())
+		return nil, err
+	}
+	if err := session.Commit(); middleware.ProcessError(err) {
+		return nil, err
+	}
+	return res, nil
 }
 
-func registerTableInsert(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/insert", tableMeta.Name),
-		func(context middleware.Context) {
+func registerTableInsert(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "insert", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			params, err := context.GetJSON()
 			if middleware.ProcessError(err) || len(params) <= 0 {
 				_ = context.ApiResponse(-1, "参数错误", nil)
 				return
 			}
 			Logger.InfoF("获取insert调用: %v", params)
-			id, err := doInsert(*GetEngine().NewSession(), SqlConf{
-				Id:    tableMeta.Name,
-				Table: tableMeta.Name,
-			}, params, nil)
+			id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doInsert(session, SqlConf{
+					Id:         tableMeta.Name,
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
 			if err != nil {
 				_ = context.ApiResponse(-1, err.Error(), nil)
 				return
@@ -136,58 +323,134 @@ func registerTableInsert(tableMeta core.Table) {
 		})
 }
 
-func registerTableDelete(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/delete", tableMeta.Name),
-		func(context middleware.Context) {
+func registerTableUpsert(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "upsert", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			params, err := context.GetJSON()
-			if err != nil || len(params) <= 0 {
+			if middleware.ProcessError(err) || len(params) <= 0 {
 				_ = context.ApiResponse(-1, "参数错误", nil)
 				return
 			}
-			primaryValue, ok := params["id"]
-			if !ok || primaryValue == nil {
-				_ = context.ApiResponse(-1, "删除数据必须指定id值", nil)
+			Logger.InfoF("获取upsert调用: %v", params)
+			id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doUpsert(session, SqlConf{
+					Id:         tableMeta.Name,
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
+			if err != nil {
+				_ = context.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			_ = context.ApiResponse(0, "", id)
+		})
+}
+
+func registerTableBatchInsert(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "batchInsert", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			var rows []map[string]interface{}
+			err := json.Unmarshal(context.GetBody(), &rows)
+			if err != nil || len(rows) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误, 需要对象数组", nil)
+				return
+			}
+			Logger.InfoF("获取batchInsert调用: %d条", len(rows))
+			ids, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doBatchInsert(session, SqlConf{
+					Id:         tableMeta.Name,
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, rows, requestParams(context))
+			})
+			if err != nil {
+				_ = context.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			_ = context.ApiResponse(0, "", ids)
+		})
+}
+
+func registerTableDelete(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "delete", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			params, err := context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
 				return
 			}
 			if len(tableMeta.PrimaryKeys) <= 0 {
 				_ = context.ApiResponse(-1, "表不存在主键, 无法删除数据", nil)
 				return
 			}
-			Logger.InfoF("获取delete调用: %v", params)
-			primaryKey := tableMeta.PrimaryKeys[0]
-			sql := fmt.Sprintf("delete from %s where %s = ?;", tableMeta.Name, primaryKey)
-			res, err := dbApiInstance.GetEngine().Exec(sql, primaryValue)
-			if !middleware.ProcessError(err) {
-				logSql(context, sql, []interface{}{primaryValue})
-				rowsAffected, err := res.RowsAffected()
-				if !middleware.ProcessError(err) {
-					_ = context.ApiResponse(0, "success", rowsAffected)
+			// 单一主键时兼容使用id指定主键值
+			if len(tableMeta.PrimaryKeys) == 1 {
+				primaryKey := tableMeta.PrimaryKeys[0]
+				if _, ok := params[primaryKey]; !ok {
+					params[primaryKey] = params["id"]
+				}
+				if params[primaryKey] == nil {
+					_ = context.ApiResponse(-1, "删除数据必须指定id值", nil)
 					return
-				} else {
-					_ = context.ApiResponse(-1, err.Error(), nil)
 				}
-			} else {
+			}
+			Logger.InfoF("获取delete调用: %v", params)
+			rowsAffected, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doDelete(session, SqlConf{
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
+			if middleware.ProcessError(err) {
 				_ = context.ApiResponse(-1, err.Error(), nil)
 				return
 			}
+			_ = context.ApiResponse(0, "success", rowsAffected)
 		})
 }
 
-func registerTableUpdate(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/update", tableMeta.Name),
-		func(context middleware.Context) {
+func registerTableRestore(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "restore", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			params, err := context.GetJSON()
 			if err != nil || len(params) <= 0 {
 				_ = context.ApiResponse(-1, "参数错误", nil)
 				return
 			}
-			Logger.InfoF("获取update调用: %v", params)
-			res, err := doUpdate(*GetEngine().NewSession(), SqlConf{
-				Table: tableMeta.Name,
-			}, params)
+			Logger.InfoF("获取restore调用: %v", params)
+			res, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doRestore(session, SqlConf{
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
 			if err != nil {
 				_ = context.ApiResponse(-1, err.Error(), nil)
 				return
+			}
+			_ = context.ApiResponse(0, "success", res)
+		})
+}
+
+func registerTableUpdate(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "update", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			params, err := context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
+				return
+			}
+			Logger.InfoF("获取update调用: %v", params)
+			res, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doUpdate(session, SqlConf{
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
+			if err != nil {
+				_ = context.ApiResponse(errorCode(err), err.Error(), nil)
+				return
 			} else {
 				_ = context.ApiResponse(0, "success", res)
 				return
@@ -195,17 +458,77 @@ func registerTableUpdate(tableMeta core.Table) {
 		})
 }
 
-func registerTableSelect(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/select", tableMeta.Name),
-		func(context middleware.Context) {
+func registerTableUpdateWhere(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "updateWhere", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			params, err := context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
+				return
+			}
+			Logger.InfoF("获取updateWhere调用: %v", params)
+			res, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doUpdateWhere(session, SqlConf{
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
+			if err != nil {
+				_ = context.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			_ = context.ApiResponse(0, "success", res)
+		})
+}
+
+func registerTableDeleteWhere(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "deleteWhere", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			params, err := context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
+				return
+			}
+			Logger.InfoF("获取deleteWhere调用: %v", params)
+			res, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+				return doDeleteWhere(session, SqlConf{
+					Table:      tableMeta.Name,
+					Datasource: dbApi.name,
+				}, params, requestParams(context))
+			})
+			if err != nil {
+				_ = context.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			_ = context.ApiResponse(0, "success", res)
+		})
+}
+
+func registerTableSelect(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "select", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			params, err := context.GetJSON()
 			if err != nil {
 				params = nil
 			}
 			Logger.InfoF("获取select调用: %v", params)
-			res, err := doSelect(*GetEngine().NewSession(), SqlConf{
-				Table:  tableMeta.Name,
-				HasSql: false,
+			if isPageQuery(params) {
+				page, err := doPage(*dbApi.readSession(consistentRead(context, params)), SqlConf{
+					Table:      tableMeta.Name,
+					HasSql:     false,
+					Datasource: dbApi.name,
+				}, params, nil)
+				if middleware.ProcessError(err) {
+					_ = context.ApiResponse(-1, err.Error(), nil)
+					return
+				}
+				_ = context.ApiResponse(0, "", page)
+				return
+			}
+			res, err := doSelect(*dbApi.readSession(consistentRead(context, params)), SqlConf{
+				Table:      tableMeta.Name,
+				HasSql:     false,
+				Datasource: dbApi.name,
 			}, params, nil)
 			if middleware.ProcessError(err) {
 				_ = context.ApiResponse(-1, err.Error(), nil)
@@ -216,17 +539,89 @@ func registerTableSelect(tableMeta core.Table) {
 		})
 }
 
-func registerTableCount(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/count", tableMeta.Name),
-		func(context middleware.Context) {
+// 按主键获取单条数据
+//
+// POST <table>/get {"id" : 1}
+//
+// GET <table>/<id>, 复合主键使用查询参数 GET <table>/?k1=v1&k2=v2
+func registerTableGet(dbApi *DbApi, tableName string) {
+	handler := func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+		var params map[string]interface{}
+		if context.Request.Method == http.MethodGet {
+			params = make(map[string]interface{})
+			for k, v := range context.Request.URL.Query() {
+				if len(v) > 0 {
+					params[k] = v[0]
+				}
+			}
+			id := context.Request.URL.Path[strings.LastIndex(context.Request.URL.Path, "/")+1:]
+			if len(id) > 0 && id != "get" {
+				params["id"] = id
+			}
+		} else {
+			var err error
+			params, err = context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
+				return
+			}
+		}
+		// 单一主键时兼容使用id指定主键值
+		if len(tableMeta.PrimaryKeys) == 1 {
+			if _, ok := params[tableMeta.PrimaryKeys[0]]; !ok {
+				params[tableMeta.PrimaryKeys[0]] = params["id"]
+			}
+		}
+		Logger.InfoF("获取get调用: %v", params)
+		res, err := doGet(*dbApi.readSession(consistentRead(context, params)), SqlConf{
+			Table:      tableMeta.Name,
+			Datasource: dbApi.name,
+		}, params)
+		if err != nil {
+			_ = context.ApiResponse(errorCode(err), err.Error(), nil)
+			return
+		}
+		_ = context.ApiResponse(0, "", res)
+	}
+	registerTableRoute(dbApi, "get", tableName, handler)
+	registerTableRoute(dbApi, "", tableName, handler)
+}
+
+func registerTableCount(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "count", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			params, err := context.GetJSON()
 			if err != nil {
 				params = nil
 			}
-			Logger.InfoF("获取select调用: %v", params)
-			res, err := doCount(*GetEngine().NewSession(), SqlConf{
-				Table:  tableMeta.Name,
-				HasSql: false,
+			Logger.InfoF("获取count调用: %v", params)
+			res, err := doCount(*dbApi.readSession(consistentRead(context, params)), SqlConf{
+				Table:      tableMeta.Name,
+				HasSql:     false,
+				Datasource: dbApi.name,
+			}, params, nil)
+			if middleware.ProcessError(err) {
+				_ = context.ApiResponse(-1, err.Error(), nil)
+				return
+			}
+			_ = context.ApiResponse(0, "", res)
+			return
+		})
+}
+
+func registerTableAggregate(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "aggregate", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
+			params, err := context.GetJSON()
+			if err != nil || len(params) <= 0 {
+				_ = context.ApiResponse(-1, "参数错误", nil)
+				return
+			}
+			Logger.InfoF("获取aggregate调用: %v", params)
+			res, err := doAggregate(*dbApi.readSession(consistentRead(context, params)), SqlConf{
+				Table:      tableMeta.Name,
+				HasSql:     false,
+				Datasource: dbApi.name,
 			}, params, nil)
 			if middleware.ProcessError(err) {
 				_ = context.ApiResponse(-1, err.Error(), nil)
@@ -237,10 +632,10 @@ func registerTableCount(tableMeta core.Table) {
 		})
 }
 
-func registerTableSchema(tableMeta core.Table) {
-	middleware.RegisterHandler(fmt.Sprintf("%s/schema", tableMeta.Name),
-		func(context middleware.Context) {
+func registerTableSchema(dbApi *DbApi, tableName string) {
+	registerTableRoute(dbApi, "schema", tableName,
+		func(context middleware.Context, dbApi *DbApi, tableMeta core.Table) {
 			_ = context.ApiResponse(0, "",
-				tableMeta.Columns())
+				dbApi.visibleColumns(tableMeta))
 		})
 }
@@ -13,6 +13,7 @@ import (
 type SqlApi struct {
 	Result      int
 	Path        string
+	Datasource  string // 数据源名称, 为空时使用默认数据源
 	Transaction bool
 	Sqls        []SqlConf
 	Params      map[string]string
@@ -21,13 +22,14 @@ type SqlApi struct {
 }
 
 type SqlConf struct {
-	HasSql    bool
-	Type      string
-	Table     string
-	SqlOrigin string
-	RParams   []SqlParam
-	Params    []SqlParam
-	Id        string
+	HasSql     bool
+	Type       string
+	Table      string
+	SqlOrigin  string
+	RParams    []SqlParam
+	Params     []SqlParam
+	Id         string
+	Datasource string
 }
 
 type SqlParam struct {
@@ -50,6 +52,8 @@ const (
 	Select = "select"
 	Update = "update"
 	Delete = "delete"
+	Count  = "count"
+	Upsert = "upsert"
 )
 
 const (
@@ -69,22 +73,26 @@ var postReg = regexp.MustCompile("\\$\\{(.*?)\\}")
 var resultReplaceReg = "#\\{%s\\.(.*?)\\}"
 var resultReg = "$\\{%s\\.(.*?)\\}"
 var replaceReg = regexp.MustCompile("#\\{(.*?)\\}")
-var sqlApis = make(map[string]SqlApi)
 
 // 初始化数据库api配置
 //
-// 可重复更新配置
+// 可重复更新配置, 配置解析完成后整体替换
 //
 // 配置文件路径
 func InitSqlConfApi(filePath string) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
 	apiConf := middleware.LoadXml(filePath)
 	apiElements := apiConf.FindElements("//sqlApi")
+	sqlApis := make([]SqlApi, 0, len(apiElements))
 	for _, apiEle := range apiElements {
 		sqlIds := make([]string, 0)
 		sqlApi := *new(SqlApi)
 		sqlApi.Transaction = apiEle.SelectAttrValue("transaction", "") == "true"
 		sqlApi.PassError = apiEle.SelectAttrValue("passError", "") == "true"
 		sqlApi.Path = apiEle.SelectAttrValue("path", "")
+		sqlApi.Datasource = apiEle.SelectAttrValue("datasource", "")
 
 		sqlApi.Sqls = make([]SqlConf, 0)
 
@@ -96,6 +104,7 @@ func InitSqlConfApi(filePath string) {
 		for i, sqlEle := range apiEle.FindElements(".//sql") {
 			oneSql := new(SqlConf)
 			oneSql.Table = sqlEle.SelectAttrValue("table", "")
+			oneSql.Datasource = sqlApi.Datasource
 			oneSql.Id = sqlEle.SelectAttrValue("id", strconv.Itoa(i))
 			sqlIds = append(sqlIds, oneSql.Id)
 			sqlStr := strings.TrimSpace(sqlEle.Text())
@@ -124,19 +133,44 @@ func InitSqlConfApi(filePath string) {
 			}
 		}
 
-		// 注册每个配置对应的接口服务
-		sqlApis[sqlApi.Path] = sqlApi
-		registerSqlConfApi(sqlApi)
+		sqlApis = append(sqlApis, sqlApi)
 	}
 
+	updateState(func(s *runtimeState) {
+		for _, sqlApi := range sqlApis {
+			s.sqlApis[sqlApi.Path] = sqlApi
+		}
+	})
+	// 注册每个配置对应的接口服务
+	for _, sqlApi := range sqlApis {
+		registerSqlConfApi(sqlApi)
+	}
 }
 
+// 执行sql配置接口, 结果均为字符串, NULL为空字符串
 func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]string, error) {
-	sqlApi, ok := sqlApis[path]
+	res, err := execSqlConfApi(params, path, nil)
+	return untypedRows(res), err
+}
+
+// 执行sql配置接口, 结果按列类型转换, 与接口返回的数据一致
+func ExecSqlConfApiTyped(params map[string]interface{}, path string) ([]map[string]interface{}, error) {
+	return execSqlConfApi(params, path, nil)
+}
+
+// 执行sql配置接口, reqParams 为请求相关参数, 如请求人 ${principal.id}, 不返回给调用方
+func execSqlConfApi(params map[string]interface{}, path string,
+	reqParams map[string]string) ([]map[string]interface{}, error) {
+
+	sqlApi, ok := loadState().sqlApis[path]
 	sqlApiParams := make(map[string]string)
 	if !ok {
 		return nil, errors.New("没有该路径sqlApi配置")
 	}
+	for k, v := range reqParams {
+		sqlApiParams[k] = v
+	}
+	seedReservedParams(sqlApiParams)
 
 	// 必须具有参数列表
 
@@ -150,12 +184,25 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 		}
 	}
 
-	session := dbApiInstance.GetEngine().NewSession()
+	dbApi := GetDbApi(sqlApi.Datasource)
+	if dbApi == nil {
+		return nil, errors.New(fmt.Sprintf("数据源 %s 不存在", sqlApi.Datasource))
+	}
+	// 非事务且只包含查询时优先使用从库
+	consistent, _ := params["consistent"].(bool)
+	session := dbApi.readSession(!sqlApi.readOnly() || consistent)
 	defer session.Close()
+	// 开启审计时写操作在事务中执行, 保证审计记录与数据一致
+	if auditEnabled() && !sqlApi.readOnly() {
+		sqlApi.Transaction = true
+	}
 	if sqlApi.Transaction {
-		session.Begin()
+		if err := session.Begin(); middleware.ProcessError(err) {
+			return nil, err
+		}
 	}
-	result := make([]map[string]string, 0)
+	result := make([]map[string]interface{}, 0)
+	countParams := make([]string, 0)
 
 	for _, sqlInstance := range sqlApi.Sqls {
 		if sqlInstance.HasSql {
@@ -173,7 +220,7 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 					sqlApiParams[fmt.Sprintf("%s.id", sqlInstance.Id)] = fmt.Sprintf("%v", id)
 				}
 			}
-			if a, b := oneSqlRes.([]map[string]string); b {
+			if a, b := oneSqlRes.([]map[string]interface{}); b {
 				result = append(result, a...)
 			}
 			continue
@@ -205,6 +252,18 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 			// 增加id配置处理
 			sqlApiParams[fmt.Sprintf("%s.id", sqlInstance.Id)] = fmt.Sprintf("%v", id)
 			break
+		case "upsert" == sqlInstance.Type:
+			id, err := doUpsert(*session, sqlInstance, params, sqlApiParams)
+			if middleware.ProcessError(err) {
+				if !sqlApi.PassError {
+					if sqlApi.Transaction {
+						middleware.ProcessError(session.Rollback())
+					}
+					return result, err
+				}
+			}
+			sqlApiParams[fmt.Sprintf("%s.id", sqlInstance.Id)] = fmt.Sprintf("%v", id)
+			break
 		case "select" == sqlInstance.Type:
 			oneSqlRes, err := doSelect(*session, sqlInstance, params, sqlApiParams)
 			if middleware.ProcessError(err) {
@@ -217,8 +276,23 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 			}
 			result = append(result, oneSqlRes...)
 			break
+		case "count" == sqlInstance.Type:
+			count, err := doCount(*session, sqlInstance, params, sqlApiParams)
+			if middleware.ProcessError(err) {
+				if !sqlApi.PassError {
+					if sqlApi.Transaction {
+						middleware.ProcessError(session.Rollback())
+					}
+					return result, err
+				}
+			}
+			// 统计结果以 {"<id>" : count} 返回, 之后的sql可通过 ${<id>.count} 使用
+			result = append(result, map[string]interface{}{sqlInstance.Id: count})
+			sqlApiParams[fmt.Sprintf("%s.count", sqlInstance.Id)] = fmt.Sprintf("%d", count)
+			countParams = append(countParams, fmt.Sprintf("%s.count", sqlInstance.Id))
+			break
 		case "update" == sqlInstance.Type:
-			_, err := doUpdate(*session, sqlInstance, params)
+			_, err := doUpdate(*session, sqlInstance, params, sqlApiParams)
 			if middleware.ProcessError(err) {
 				if !sqlApi.PassError {
 					if sqlApi.Transaction {
@@ -229,7 +303,7 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 			}
 			break
 		case "delete" == sqlInstance.Type:
-			err := doDelete(*session, sqlInstance, params)
+			_, err := doDelete(*session, sqlInstance, params, sqlApiParams)
 			if middleware.ProcessError(err) {
 				if !sqlApi.PassError {
 					if sqlApi.Transaction {
@@ -242,12 +316,24 @@ func ExecSqlConfApi(params map[string]interface{}, path string) ([]map[string]st
 		}
 
 	}
+	for k := range reqParams {
+		delete(sqlApiParams, k)
+	}
+	for _, k := range reservedParams {
+		delete(sqlApiParams, k)
+	}
+	for _, k := range countParams {
+		delete(sqlApiParams, k)
+	}
 	if len(sqlApiParams) > 0 {
-		result = append(result, sqlApiParams)
+		result = append(result, stringRow(sqlApiParams))
 	}
 
 	if sqlApi.Transaction {
-		middleware.ProcessError(session.Commit())
+		if err := session.Commit(); middleware.ProcessError(err) {
+			middleware.ProcessError(session.Rollback())
+			return nil, err
+		}
 	}
 	return result, nil
 }
@@ -258,9 +344,15 @@ func registerSqlConfApi(sqlApi SqlApi) {
 		return
 	}
 	Logger.InfoF("注册sql api服务: %#v", sqlApi)
-	middleware.RegisterHandler(sqlApi.Path,
+	// 处理时使用当前的配置
+	path := sqlApi.Path
+	registerRoute(path,
 		func(context middleware.Context) {
-			sqlApi := sqlApi
+			sqlApi, ok := loadState().sqlApis[path]
+			if !ok {
+				_ = context.ApiResponse(-1, "没有该路径sqlApi配置", nil)
+				return
+			}
 			jsonData, err := context.GetJSON()
 			if middleware.ProcessError(err) {
 				jsonData = make(map[string]interface{})
@@ -280,9 +372,9 @@ func registerSqlConfApi(sqlApi SqlApi) {
 					}
 				}
 			}
-			res, err := ExecSqlConfApi(jsonData, sqlApi.Path)
+			res, err := execSqlConfApi(jsonData, sqlApi.Path, requestParams(context))
 			if middleware.ProcessError(err) {
-				_ = context.ApiResponse(-1, err.Error(), nil)
+				_ = context.ApiResponse(errorCode(err), err.Error(), nil)
 				return
 			} else {
 				_ = context.ApiResponse(0, "", res)
@@ -0,0 +1,219 @@
+package dbrest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 支持的数据库驱动, 通过 db.driver 或 db.<name>.driver 配置, 默认mysql
+//
+// mysql 驱动默认导入, postgres 需使用 -tags postgres 编译, sqlite3 需使用 -tags sqlite 编译并开启cgo,
+// 也可以由调用方自行导入驱动
+const (
+	DriverMysql    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSqlite   = "sqlite3"
+)
+
+// 获取数据源的数据库驱动
+func dbDriver(name string) string {
+	driver := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), datasourceKey(name, "driver")))
+	if len(driver) <= 0 {
+		return DriverMysql
+	}
+	return driver
+}
+
+// 驱动是否已注册
+func driverRegistered(driver string) bool {
+	for _, registered := range sql.Drivers() {
+		if registered == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据驱动生成数据源
+//
+// 可选配置, 命名数据源使用 db.<name>.<key>:
+// {
+// 	"db.charset" : "utf8",
+// 	"db.utf8mb4" : true,
+// 	"db.parseTime" : true,
+// 	"db.loc" : "Local",
+// 	"db.timeout" : "5s",
+// 	"db.readTimeout" : "30s",
+// 	"db.writeTimeout" : "30s",
+// 	"db.tls" : "true",
+// 	"db.params" : "interpolateParams=true&collation=utf8mb4_general_ci"
+// }
+//
+// postgres 的 tls 对应 sslmode, 默认 disable, timeout 对应 connect_timeout
+//
+// sqlite3 使用 db.database 作为数据库文件路径, 只使用 db.params
+func dataSourceName(name string, driver string, host string, port int, user string,
+	password string, db string) (string, error) {
+
+	extraParams, err := url.ParseQuery(datasourceConf(name, "params"))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("数据源参数配置错误 %s", err.Error()))
+	}
+	switch driver {
+	case DriverMysql:
+		params := url.Values{}
+		charset := datasourceConf(name, "charset")
+		if len(charset) <= 0 {
+			charset = "utf8"
+		}
+		if datasourceConf(name, "utf8mb4") == "true" {
+			charset = "utf8mb4"
+		}
+		params.Set("charset", charset)
+		for _, key := range []string{"parseTime", "loc", "timeout", "readTimeout", "writeTimeout", "tls"} {
+			if value := datasourceConf(name, key); len(value) > 0 {
+				params.Set(key, value)
+			}
+		}
+		for key, values := range extraParams {
+			params[key] = values
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?%s",
+			user, password, host, port, db, params.Encode()), nil
+	case DriverPostgres:
+		sslMode := datasourceConf(name, "tls")
+		if len(sslMode) <= 0 {
+			sslMode = "disable"
+		}
+		dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+			host, port, user, password, db, sslMode)
+		if timeout := datasourceConf(name, "timeout"); len(timeout) > 0 {
+			duration, err := parseDuration(timeout)
+			if err != nil {
+				return "", err
+			}
+			dsn = fmt.Sprintf("%s connect_timeout=%d", dsn, int(duration.Seconds()))
+		}
+		for _, key := range sortedParamKeys(extraParams) {
+			dsn = fmt.Sprintf("%s %s=%s", dsn, key, extraParams.Get(key))
+		}
+		return dsn, nil
+	case DriverSqlite:
+		if len(extraParams) > 0 {
+			return fmt.Sprintf("%s?%s", db, extraParams.Encode()), nil
+		}
+		return db, nil
+	}
+	return "", errors.New(fmt.Sprintf("不支持的数据库驱动 %s", driver))
+}
+
+// 参数名排序
+func sortedParamKeys(params url.Values) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 解析时间配置, 支持 30s, 5m 等格式, 纯数字时单位为秒
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("时间配置错误 %s", value))
+	}
+	return duration, nil
+}
+
+// 数据源中不带时区的时间值使用的时区
+//
+// 使用数据源的 loc 配置, 与 mysql 连接参数一致, 未配置时 db.audit.utc 为true使用UTC, 否则使用本地时区
+func datasourceLocation(name string) *time.Location {
+	if loc := datasourceConf(name, "loc"); len(loc) > 0 {
+		location, err := time.LoadLocation(loc)
+		if err == nil {
+			return location
+		}
+		Logger.ErrorF("时区配置错误 %s: %s", loc, err.Error())
+	}
+	if strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.audit.utc")) == "true" {
+		return time.UTC
+	}
+	return time.Local
+}
+
+// 数据源的数据库类型
+func (this *DbApi) dbType() core.DbType {
+	return this.GetEngine().Dialect().DBType()
+}
+
+// 按数据库方言引用表名或列名, 避免与关键字冲突
+func (this *DbApi) quote(name string) string {
+	return this.GetEngine().Quote(name)
+}
+
+// 引用多个列名并拼接
+func (this *DbApi) quoteColumns(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, this.quote(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// 分页语句, 各数据库通用
+func limitSql(offset int, size int) string {
+	return fmt.Sprintf("limit %d offset %d", size, offset)
+}
+
+// 执行插入语句, 按顺序返回自增主键, 表中没有自增列时返回nil
+//
+// mysql 通过 LastInsertId 获取, 多行插入时返回第一行的自增id, 同一语句中的自增id连续 (auto_increment_increment 为1)
+//
+// postgres 及 sqlite 使用 returning 获取, sqlite 需3.35以上版本
+func execInsert(session xorm.Session, dbApi *DbApi, tableMeta core.Table, sql string,
+	values []interface{}, rows int) ([]interface{}, error) {
+
+	autoIncrement := tableMeta.AutoIncrColumn()
+	if autoIncrement != nil && dbApi.dbType() != core.MYSQL {
+		res, err := session.QueryInterface(append([]interface{}{
+			fmt.Sprintf("%s returning %s;", sql, dbApi.quote(autoIncrement.Name))}, values...)...)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]interface{}, 0, len(res))
+		for _, row := range res {
+			ids = append(ids, typedValue(row[autoIncrement.Name], autoIncrement, nil))
+		}
+		return ids, nil
+	}
+	res, err := session.Exec(append([]interface{}{sql + ";"}, values...)...)
+	if err != nil {
+		return nil, err
+	}
+	if autoIncrement == nil {
+		return nil, nil
+	}
+	lid, err := res.LastInsertId()
+	if err != nil {
+		return nil, nil
+	}
+	ids := make([]interface{}, 0, rows)
+	for i := 0; i < rows; i++ {
+		ids = append(ids, lid+int64(i))
+	}
+	return ids, nil
+}
@@ -1,35 +1,337 @@
 package dbrest
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/go-xorm/core"
 	"github.com/go-xorm/xorm"
 	"github.com/wenlaizhou/middleware"
+	"strconv"
 	"strings"
 )
 
+// 数据不存在
+var ErrNotFound = errors.New("数据不存在")
+
+// 数据版本冲突, 数据已被其他请求修改
+var ErrVersionConflict = errors.New("数据版本冲突, 请刷新后重试")
+
 // 执行插入操作
 func doInsert(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
 	confParams map[string]string) (interface{}, error) {
 
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	row, err := buildInsertRow(dbApi, tableMeta, requestJson, confParams)
+	if err != nil {
+		return nil, err
+	}
+	sql := fmt.Sprintf("insert into %s (%s) values (%s)", dbApi.quote(tableMeta.Name), row.columnsStr, row.valuesStr)
+	autoIds, err := execInsert(session, dbApi, tableMeta, sql, row.values, 1)
+	if middleware.ProcessError(err) {
+		return nil, err
+	}
+	id := insertedId(row, autoIds, 0)
+	err = auditTableRow(session, dbApi, tableMeta, Insert, insertedKey(tableMeta, id), nil, confParams)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// 获取新增数据的主键, 非自增主键使用生成的值, 否则使用第i个自增id
+func insertedId(row insertRow, autoIds []interface{}, i int) interface{} {
+	if row.id != nil {
+		return row.id
+	}
+	if i < len(autoIds) {
+		return autoIds[i]
+	}
+	return nil
+}
+
+// 执行插入或更新操作
+//
+// 主键冲突时更新除主键, 创建时间及创建人以外的列
+//
+// mysql 使用 on duplicate key update, postgres 及 sqlite 使用 on conflict (主键) do update,
+// 只按主键判断数据是否存在, 表中有其他唯一键时 postgres 及 sqlite 冲突返回错误, mysql 会更新冲突的数据
+//
+// 请求中指定自增主键时插入该值, 主键存在时更新
+func doUpsert(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
+	confParams map[string]string) (interface{}, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	return upsertRow(session, dbApi, dbApi.GetMeta(sqlConf.Table), requestJson, confParams)
+}
+
+// 按表结构执行插入或更新, 通用接口及结构体接口共用
+func upsertRow(session xorm.Session, dbApi *DbApi, tableMeta core.Table,
+	requestJson map[string]interface{}, confParams map[string]string) (interface{}, error) {
+
+	dialect := dbApi.dbType()
+	if len(tableMeta.PrimaryKeys) <= 0 {
+		return nil, errors.New("当前操作只支持有主键的表")
+	}
+	row, err := buildInsertRow(dbApi, tableMeta, requestJson, confParams)
+	if err != nil {
+		return nil, err
+	}
+	autoIncrementKey := upsertAutoIncrementKey(dbApi, tableMeta, requestJson, &row)
+	audit := tableAudit(dbApi, tableMeta)
+
+	updates := make([]string, 0)
+	for _, columnName := range row.columns {
+		if audit.isCreateColumn(columnName) || columnName == "is_delete" || isPrimaryKey(tableMeta, columnName) {
+			continue
+		}
+		quoted := dbApi.quote(columnName)
+		if dialect == core.MYSQL {
+			updates = append(updates, fmt.Sprintf("%s = values(%s)", quoted, quoted))
+		} else {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", quoted, quoted))
+		}
+	}
+
+	primaryKey := insertedKey(tableMeta, row.id)
+	if primaryKey == nil {
+		primaryKey = primaryValues(tableMeta, requestJson)
+	}
+	before, err := auditImage(session, dbApi, tableMeta, primaryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := dbApi.quote(tableMeta.Name)
+	sql := fmt.Sprintf("insert into %s (%s) values (%s)", tableName, row.columnsStr, row.valuesStr)
+	if autoIncrementKey != nil && dialect == core.POSTGRES {
+		// identity 列需指定 overriding system value 才能插入指定的值
+		sql = fmt.Sprintf("insert into %s (%s) overriding system value values (%s)",
+			tableName, row.columnsStr, row.valuesStr)
+	}
+	primaryKeys := dbApi.quoteColumns(tableMeta.PrimaryKeys)
+	if dialect == core.MYSQL {
+		// 更新时通过 last_insert_id 返回已存在数据的自增主键
+		if autoIncrement := tableMeta.AutoIncrColumn(); autoIncrement != nil {
+			quoted := dbApi.quote(autoIncrement.Name)
+			updates = append(updates, fmt.Sprintf("%s = last_insert_id(%s)", quoted, quoted))
+		}
+		if len(updates) <= 0 {
+			quoted := dbApi.quote(tableMeta.PrimaryKeys[0])
+			updates = append(updates, fmt.Sprintf("%s = %s", quoted, quoted))
+		}
+		sql = fmt.Sprintf("%s on duplicate key update %s", sql, strings.Join(updates, ", "))
+	} else if len(updates) <= 0 {
+		sql = fmt.Sprintf("%s on conflict (%s) do nothing", sql, primaryKeys)
+	} else {
+		sql = fmt.Sprintf("%s on conflict (%s) do update set %s", sql, primaryKeys, strings.Join(updates, ", "))
+	}
+	autoIds, err := execInsert(session, dbApi, tableMeta, sql, row.values, 1)
+	if middleware.ProcessError(err) {
+		return nil, err
+	}
+	if autoIncrementKey != nil && dialect == core.POSTGRES {
+		// 插入指定值不会推进序列, 同步序列避免之后的插入主键冲突
+		// pg_get_serial_sequence 的表名按标识符解析, 列名按原样使用
+		_, err = session.Exec(fmt.Sprintf(
+			"select setval(pg_get_serial_sequence('%s', '%s'), (select max(%s) from %s));",
+			tableName, autoIncrementKey.Name, dbApi.quote(autoIncrementKey.Name), tableName))
+		if middleware.ProcessError(err) {
+			return nil, err
+		}
+	}
+	id := insertedId(row, autoIds, 0)
+	if id == nil {
+		// do nothing 时 returning 不返回数据, 使用请求中的主键
+		id = requestKey(tableMeta, requestJson)
+	}
+	err = auditTableRow(session, dbApi, tableMeta, Upsert, insertedKey(tableMeta, id), before, confParams)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// 请求中的主键值, 单一主键时返回值, 复合主键时返回主键名与值的map, 主键不完整时返回nil
+func requestKey(tableMeta core.Table, requestJson map[string]interface{}) interface{} {
+	primaryKey := primaryValues(tableMeta, requestJson)
+	if primaryKey == nil {
+		return nil
+	}
+	if len(tableMeta.PrimaryKeys) == 1 {
+		return primaryKey[tableMeta.PrimaryKeys[0]]
+	}
+	return primaryKey
+}
+
+// 插入或更新时请求中指定了自增主键, 将该值加入插入数据行, 返回自增主键列, 未指定时返回nil
+func upsertAutoIncrementKey(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{},
+	row *insertRow) *core.Column {
+
+	autoIncrement := tableMeta.AutoIncrColumn()
+	if autoIncrement == nil || !isPrimaryKey(tableMeta, autoIncrement.Name) {
+		return nil
+	}
+	v, ok := requestJson[autoIncrement.Name]
+	if !ok || v == nil || !isScalar(v) {
+		return nil
+	}
+	row.addColumn(dbApi, autoIncrement.Name)
+	row.valuesStr = appendValueStr(row.valuesStr)
+	row.values = append(row.values, v)
+	if ids, ok := row.id.(map[string]interface{}); ok {
+		ids[autoIncrement.Name] = v
+	} else if len(tableMeta.PrimaryKeys) == 1 {
+		row.id = v
+	} else {
+		row.id = map[string]interface{}{autoIncrement.Name: v}
+	}
+	return autoIncrement
+}
+
+// 构建主键条件, 复合主键时所有主键都必须指定
+func primaryCondition(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (string, []interface{}, error) {
+	if len(tableMeta.PrimaryKeys) <= 0 {
+		return "", nil, errors.New("该表没有主键")
+	}
+	where := ""
 	var values []interface{}
+	missing := make([]string, 0)
+	for _, primaryKey := range tableMeta.PrimaryKeys {
+		primaryValue, ok := requestJson[primaryKey]
+		if !ok || primaryValue == nil || !isScalar(primaryValue) {
+			missing = append(missing, primaryKey)
+			continue
+		}
+		where = appendCondition(where, fmt.Sprintf("%s = ?", dbApi.quote(primaryKey)))
+		values = append(values, primaryValue)
+	}
+	if len(missing) > 0 {
+		return "", nil, errors.New(fmt.Sprintf("参数错误, 没有主键 %s", strings.Join(missing, ", ")))
+	}
+	return where, values, nil
+}
+
+// 是否为主键列
+func isPrimaryKey(tableMeta core.Table, columnName string) bool {
+	for _, primaryKey := range tableMeta.PrimaryKeys {
+		if strings.EqualFold(primaryKey, columnName) {
+			return true
+		}
+	}
+	return false
+}
+
+// 默认批量插入每批数量, 可通过 db.batchSize 配置
+const defaultBatchSize = 100
+
+// 执行批量插入操作
+//
+// 所有数据的列必须一致, 按批生成多行insert语句, 需在事务中调用
+//
+// 按顺序返回每条数据的guid主键或自增主键
+func doBatchInsert(session xorm.Session, sqlConf SqlConf, rows []map[string]interface{},
+	confParams map[string]string) ([]interface{}, error) {
+
+	if len(rows) <= 0 {
+		return nil, errors.New("参数错误, 没有需要插入的数据")
+	}
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	insertRows := make([]insertRow, 0, len(rows))
+	for i, requestJson := range rows {
+		if requestJson == nil {
+			return nil, errors.New(fmt.Sprintf("参数错误, 第%d条数据为空", i+1))
+		}
+		row, err := buildInsertRow(dbApi, tableMeta, requestJson, confParams)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("第%d条数据%s", i+1, err.Error()))
+		}
+		if i > 0 && row.columnsStr != insertRows[0].columnsStr {
+			return nil, errors.New(fmt.Sprintf("参数错误, 第%d条数据的列与第1条不一致", i+1))
+		}
+		insertRows = append(insertRows, row)
+	}
+
+	size, err := middleware.ConfInt(dbConfig(), "db.batchSize")
+	if err != nil || size <= 0 {
+		size = defaultBatchSize
+	}
+	ids := make([]interface{}, 0, len(insertRows))
+	for start := 0; start < len(insertRows); start += size {
+		end := start + size
+		if end > len(insertRows) {
+			end = len(insertRows)
+		}
+		chunk := insertRows[start:end]
+		valuesStrs := make([]string, 0, len(chunk))
+		var values []interface{}
+		for _, row := range chunk {
+			valuesStrs = append(valuesStrs, fmt.Sprintf("(%s)", row.valuesStr))
+			values = append(values, row.values...)
+		}
+		sql := fmt.Sprintf("insert into %s (%s) values %s", dbApi.quote(tableMeta.Name),
+			chunk[0].columnsStr, strings.Join(valuesStrs, ", "))
+		autoIds, err := execInsert(session, dbApi, tableMeta, sql, values, len(chunk))
+		if middleware.ProcessError(err) {
+			return nil, err
+		}
+		for i, row := range chunk {
+			ids = append(ids, insertedId(row, autoIds, i))
+		}
+	}
+	for _, id := range ids {
+		err := auditTableRow(session, dbApi, tableMeta, Insert, insertedKey(tableMeta, id), nil, confParams)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// 插入数据行
+type insertRow struct {
+	columns    []string // 插入的列名
+	columnsStr string   // 引用后的列名
+	valuesStr  string
+	values     []interface{}
+	id         interface{} // 非自增主键值, 复合主键时为主键名与值的map
+}
+
+// 加入插入列
+func (this *insertRow) addColumn(dbApi *DbApi, columnName string) {
+	this.columns = append(this.columns, columnName)
+	this.columnsStr = appendColumnStr(this.columnsStr, dbApi.quote(columnName))
+}
+
+// 构建插入数据行, 列按名称排序
+//
+// 非自增单一主键未指定时生成32位guid, 复合主键必须全部指定,
+// 审计列使用当前时间及请求人, is_delete 为0
+func buildInsertRow(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{},
+	confParams map[string]string) (insertRow, error) {
+
 	if confParams == nil {
 		confParams = make(map[string]string)
 	}
-	var id = ""
-	columnsStr := ""
-	valuesStr := ""
-	tableMeta := dbApiInstance.GetMeta(sqlConf.Table)
+	audit := tableAudit(dbApi, tableMeta)
+	row := insertRow{}
 	for k, v := range confParams {
 		requestJson[k] = v
 	}
-	for k, v := range requestJson {
+
+	for _, k := range sortedKeys(requestJson) {
+		v := requestJson[k]
 		if column := tableMeta.GetColumn(k); column != nil && !column.IsAutoIncrement {
-			if column.Name == "create_time" || column.Name == "update_time" {
+			if audit.isAuditColumn(column.Name) || column.Name == "is_delete" {
+				continue
+			}
+			if isPrimaryKey(tableMeta, column.Name) {
 				continue
 			}
-			columnsStr = appendColumnStr(columnsStr, column.Name)
-			valuesStr = appendValueStr(valuesStr)
+			row.addColumn(dbApi, column.Name)
+			row.valuesStr = appendValueStr(row.valuesStr)
 			if confValue, ok := confParams[k]; ok {
 				if postReg.MatchString(confValue) {
 					confMatch := postReg.FindAllStringSubmatch(confValue, -1)
@@ -40,125 +342,414 @@ func doInsert(session xorm.Session, sqlConf SqlConf, requestJson map[string]inte
 			}
 			if str, ok := v.(string); ok {
 				str = strings.TrimSpace(str)
-				values = append(values, str)
+				row.values = append(row.values, str)
 			} else {
-				values = append(values, v)
+				row.values = append(row.values, v)
 			}
 			continue
 		}
 	}
 	// 处理is_delete
 	if isDelete := tableMeta.GetColumn("is_delete"); isDelete != nil {
-		columnsStr = appendColumnStr(columnsStr, isDelete.Name)
-		if len(valuesStr) > 0 {
-			valuesStr = fmt.Sprintf("%s, 0", valuesStr)
+		row.addColumn(dbApi, isDelete.Name)
+		if len(row.valuesStr) > 0 {
+			row.valuesStr = fmt.Sprintf("%s, 0", row.valuesStr)
 		} else {
-			valuesStr = "0"
+			row.valuesStr = "0"
 		}
 	}
 
-	if len(tableMeta.PrimaryKeys) > 0 {
-		primaryKey := tableMeta.GetColumn(tableMeta.PrimaryKeys[0]) // 限制单一主键
-		// 32位guid
-		if primaryKey != nil && !primaryKey.IsAutoIncrement {
-			id = middleware.Guid()
-			columnsStr = appendColumnStr(columnsStr, primaryKey.Name)
-			valuesStr = appendValueStr(valuesStr)
-			if confValue, ok := confParams[primaryKey.Name]; ok { // id处理器
-				if postReg.MatchString(confValue) {
-					confMatch := postReg.FindAllStringSubmatch(confValue, -1)
-					id = confParams[confMatch[0][1]]
-				} else {
-					id = confValue
-				}
+	// 处理非自增主键
+	ids := make(map[string]interface{})
+	missing := make([]string, 0)
+	for _, primaryKeyName := range tableMeta.PrimaryKeys {
+		primaryKey := tableMeta.GetColumn(primaryKeyName)
+		if primaryKey == nil || primaryKey.IsAutoIncrement {
+			continue
+		}
+		var id interface{}
+		if v, ok := requestJson[primaryKey.Name]; ok && v != nil && isScalar(v) {
+			id = v
+			if str, ok := v.(string); ok {
+				id = strings.TrimSpace(str)
 			}
-			values = append(values, id)
 		}
+		if confValue, ok := confParams[primaryKey.Name]; ok { // id处理器
+			if postReg.MatchString(confValue) {
+				confMatch := postReg.FindAllStringSubmatch(confValue, -1)
+				id = confParams[confMatch[0][1]]
+			} else {
+				id = confValue
+			}
+		}
+		if id == nil {
+			if len(tableMeta.PrimaryKeys) > 1 {
+				missing = append(missing, primaryKey.Name)
+				continue
+			}
+			id = middleware.Guid() // 32位guid
+		}
+		row.addColumn(dbApi, primaryKey.Name)
+		row.valuesStr = appendValueStr(row.valuesStr)
+		row.values = append(row.values, id)
+		ids[primaryKey.Name] = id
+	}
+	if len(missing) > 0 {
+		return row, errors.New(fmt.Sprintf("参数错误, 没有主键 %s", strings.Join(missing, ", ")))
+	}
+	if len(tableMeta.PrimaryKeys) == 1 {
+		row.id = ids[tableMeta.PrimaryKeys[0]]
+	} else if len(ids) > 0 {
+		row.id = ids
 	}
 
-	if createColumn := tableMeta.GetColumn("create_time"); createColumn != nil {
-		columnsStr = appendColumnStr(columnsStr, createColumn.Name)
-		if len(valuesStr) > 0 {
-			valuesStr = fmt.Sprintf("%s, %s", valuesStr, "now()")
-		} else {
-			valuesStr = "now()"
-		}
+	auditColumns, auditValues := audit.insertColumns(confParams)
+	for i, columnName := range auditColumns {
+		row.addColumn(dbApi, columnName)
+		row.valuesStr = appendValueStr(row.valuesStr)
+		row.values = append(row.values, auditValues[i])
 	}
-	if updateColumn := tableMeta.GetColumn("update_time"); updateColumn != nil {
-		columnsStr = appendColumnStr(columnsStr, updateColumn.Name)
-		if len(valuesStr) > 0 {
-			valuesStr = fmt.Sprintf("%s, %s", valuesStr, "now()")
-		} else {
-			valuesStr = "now()"
-		}
+	return row, nil
+}
+
+// 执行删除操作
+//
+// 表中存在is_delete字段时为软删除, 返回影响行数
+func doDelete(session xorm.Session, sqlConf SqlConf,
+	requestJson map[string]interface{}, confParams map[string]string) (int64, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	sql, values, err := buildDeleteSql(dbApi, tableMeta, requestJson, confParams)
+	if err != nil {
+		return -1, err
+	}
+	primaryKey := primaryValues(tableMeta, requestJson)
+	before, err := auditImage(session, dbApi, tableMeta, primaryKey)
+	if err != nil {
+		return -1, err
 	}
-	sql := fmt.Sprintf("insert into %s (%s) values (%s);", tableMeta.Name, columnsStr, valuesStr)
 	res, err := session.Exec(append([]interface{}{sql}, values...)...)
 	if middleware.ProcessError(err) {
-		return nil, err
+		return -1, err
 	}
-	if lid, err := res.LastInsertId(); err == nil {
-		if len(id) > 0 {
-			return id, nil
-		}
-		return lid, nil
+	return auditAffectedRow(session, dbApi, tableMeta, Delete, primaryKey, before, res, confParams)
+}
+
+// 按主键操作影响数据时写入审计记录, 返回影响行数
+func auditAffectedRow(session xorm.Session, dbApi *DbApi, tableMeta core.Table, operation string,
+	primaryKey map[string]interface{}, before map[string]interface{},
+	res sql.Result, confParams map[string]string) (int64, error) {
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected <= 0 {
+		return rowsAffected, err
 	}
-	return id, nil
+	err = auditTableRow(session, dbApi, tableMeta, operation, primaryKey, before, confParams)
+	if err != nil {
+		return -1, err
+	}
+	return rowsAffected, nil
 }
 
-// 执行删除操作
-func doDelete(session xorm.Session, sqlConf SqlConf,
-	requestJson map[string]interface{}) error {
+// 构建按主键删除语句
+//
+// 表中存在is_delete字段时设置 is_delete = 1, 否则物理删除
+func buildDeleteSql(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{},
+	confParams map[string]string) (string, []interface{}, error) {
 
-	tableMeta := dbApiInstance.GetMeta(sqlConf.Table)
-	if len(tableMeta.PrimaryKeys) <= 0 {
-		return errors.New("该表没有主键")
+	where, values, err := primaryCondition(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return "", nil, err
 	}
-	primaryValue, ok := requestJson[tableMeta.PrimaryKeys[0]]
-	if !ok || primaryValue == nil {
-		return errors.New(fmt.Sprintf("参数错误, 没有主键 %s", tableMeta.PrimaryKeys[0]))
+	extraWhere, extraValues, err := buildExtraWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return "", nil, err
 	}
+	where = appendCondition(where, extraWhere)
+	values = append(values, extraValues...)
+	if softDelete, setValues := softDeleteSet(dbApi, tableMeta, 1, confParams); len(softDelete) > 0 {
+		return fmt.Sprintf("update %s set %s where %s;", dbApi.quote(tableMeta.Name), softDelete, where),
+			append(setValues, values...), nil
+	}
+	return fmt.Sprintf("delete from %s where %s;", dbApi.quote(tableMeta.Name), where), values, nil
+}
 
-	primaryKey := tableMeta.PrimaryKeys[0]
-	sql := fmt.Sprintf("delete from %s where %s = ?;", tableMeta.Name, primaryKey)
-	_, err := session.Exec(sql, primaryValue)
-	if !middleware.ProcessError(err) {
-		return err
-	} else {
-		return nil
+// 执行恢复操作, 将软删除的数据恢复
+func doRestore(session xorm.Session, sqlConf SqlConf,
+	requestJson map[string]interface{}, confParams map[string]string) (int64, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	softDelete, values := softDeleteSet(dbApi, tableMeta, 0, confParams)
+	if len(softDelete) <= 0 {
+		return -1, errors.New("该表不支持软删除")
+	}
+	where, whereValues, err := primaryCondition(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	primaryKey := primaryValues(tableMeta, requestJson)
+	before, err := auditImage(session, dbApi, tableMeta, primaryKey)
+	if err != nil {
+		return -1, err
+	}
+	sql := fmt.Sprintf("update %s set %s where %s;", dbApi.quote(tableMeta.Name), softDelete, where)
+	values = append(values, whereValues...)
+	res, err := session.Exec(append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return -1, err
 	}
+	return auditAffectedRow(session, dbApi, tableMeta, auditRestore, primaryKey, before, res, confParams)
+}
+
+// 软删除set语句, 同时更新审计列, 表中不存在is_delete字段时返回空
+func softDeleteSet(dbApi *DbApi, tableMeta core.Table, deleted int,
+	confParams map[string]string) (string, []interface{}) {
+
+	isDelete := tableMeta.GetColumn("is_delete")
+	if isDelete == nil {
+		return "", nil
+	}
+	set := fmt.Sprintf("%s = %d", dbApi.quote(isDelete.Name), deleted)
+	auditSet, values := tableAudit(dbApi, tableMeta).updateSet(dbApi, confParams)
+	if len(auditSet) > 0 {
+		set = fmt.Sprintf("%s, %s", set, auditSet)
+	}
+	return set, values
 }
 
 // 执行更新操作
+//
+// 表中存在版本列时必须指定当前版本, 更新时版本加1, 版本不一致时返回 ErrVersionConflict
 func doUpdate(session xorm.Session, sqlConf SqlConf,
-	requestJson map[string]interface{}) (int64, error) {
+	requestJson map[string]interface{}, confParams map[string]string) (int64, error) {
 
-	tableMeta := dbApiInstance.GetMeta(sqlConf.Table)
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
 	if len(tableMeta.PrimaryKeys) <= 0 {
 		return -1, errors.New("当前操作只支持有主键的表")
 	}
-	if len(requestJson) <= 1 {
+	if len(requestJson) <= len(tableMeta.PrimaryKeys) {
 		return -1, errors.New("参数错误, 数量过少")
 	}
-	primaryKey := tableMeta.PrimaryKeys[0]
-	primaryValue, ok := requestJson[primaryKey]
-	if !ok || primaryValue == nil {
-		return -1, errors.New(fmt.Sprintf("参数错误, 没有主键 %s", tableMeta.PrimaryKeys[0]))
+	where, whereValues, err := primaryCondition(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	columnsStr, values := buildUpdateSet(dbApi, tableMeta, requestJson, confParams)
+	if len(columnsStr) <= 0 {
+		return -1, errors.New("参数错误, 没有需要更新的列")
+	}
+	extraWhere, extraValues, err := buildExtraWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	// 乐观锁, 必须指定当前版本
+	versionWhere := ""
+	var versionValues []interface{}
+	if version := versionColumn(tableMeta); version != nil {
+		versionValue, ok := requestJson[version.Name]
+		if !ok || versionValue == nil || !isScalar(versionValue) {
+			return -1, errors.New(fmt.Sprintf("参数错误, 没有版本 %s", version.Name))
+		}
+		versionWhere = fmt.Sprintf("%s = ?", dbApi.quote(version.Name))
+		versionValues = append(versionValues, versionValue)
+	}
+	primaryKey := primaryValues(tableMeta, requestJson)
+	before, err := auditImage(session, dbApi, tableMeta, primaryKey)
+	if err != nil {
+		return -1, err
+	}
+	sql := fmt.Sprintf("update %s set %s where %s;", dbApi.quote(tableMeta.Name),
+		columnsStr, appendCondition(appendCondition(where, versionWhere), extraWhere))
+	values = append(values, whereValues...)
+	values = append(values, versionValues...)
+	values = append(values, extraValues...)
+	res, err := session.Exec(append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return -1, err
+	}
+	rowsAffected, err := auditAffectedRow(session, dbApi, tableMeta, Update, primaryKey, before, res, confParams)
+	if err != nil || rowsAffected > 0 || len(versionWhere) <= 0 {
+		return rowsAffected, err
+	}
+	// 未更新数据时区分数据不存在与版本冲突
+	count, err := countWhere(session, dbApi, tableMeta.Name, where, whereValues)
+	if err != nil {
+		return -1, err
+	}
+	if count <= 0 {
+		return 0, ErrNotFound
+	}
+	return 0, ErrVersionConflict
+}
+
+// 获取乐观锁版本列, 通过 db.versionColumn 配置, 表中不存在该列时返回nil
+func versionColumn(tableMeta core.Table) *core.Column {
+	columnName := strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.versionColumn"))
+	if len(columnName) <= 0 {
+		return nil
+	}
+	return tableMeta.GetColumn(columnName)
+}
+
+// 默认按条件更新, 删除的最大影响行数, 可通过 db.maxAffectedRows 配置
+const defaultMaxAffectedRows = 1000
+
+// 执行按条件更新操作
+//
+// {"where" : {"status" : 1}, "values" : {"status" : 2}, "force" : false}
+//
+// 条件为空时必须指定force, 影响行数超过最大值时返回错误, 需在事务中调用以便回滚
+func doUpdateWhere(session xorm.Session, sqlConf SqlConf,
+	requestJson map[string]interface{}, confParams map[string]string) (int64, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	where, whereValues, err := buildBulkWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	newValues, ok := requestJson["values"].(map[string]interface{})
+	if !ok || len(newValues) <= 0 {
+		return -1, errors.New("参数错误, values 必须为非空对象")
+	}
+	columnsStr, values := buildUpdateSet(dbApi, tableMeta, newValues, confParams)
+	if len(columnsStr) <= 0 {
+		return -1, errors.New("参数错误, 没有需要更新的列")
+	}
+	befores, err := auditImages(session, dbApi, tableMeta, where, whereValues)
+	if err != nil {
+		return -1, err
+	}
+	sql := fmt.Sprintf("update %s set %s", dbApi.quote(tableMeta.Name), columnsStr)
+	if len(where) > 0 {
+		sql = fmt.Sprintf("%s where %s", sql, where)
+	}
+	res, err := session.Exec(append(append([]interface{}{sql + ";"}, values...), whereValues...)...)
+	if middleware.ProcessError(err) {
+		return -1, err
+	}
+	rowsAffected, err := checkAffectedRows(res)
+	if err != nil {
+		return rowsAffected, err
+	}
+	return rowsAffected, auditTableRows(session, dbApi, tableMeta, Update, befores, confParams)
+}
+
+// 执行按条件删除操作, 表中存在is_delete字段时为软删除
+//
+// {"where" : {"status" : 1}, "force" : false}
+//
+// 条件为空时必须指定force, 影响行数超过最大值时返回错误, 需在事务中调用以便回滚
+func doDeleteWhere(session xorm.Session, sqlConf SqlConf,
+	requestJson map[string]interface{}, confParams map[string]string) (int64, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	where, whereValues, err := buildBulkWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	befores, err := auditImages(session, dbApi, tableMeta, where, whereValues)
+	if err != nil {
+		return -1, err
+	}
+	sql := fmt.Sprintf("delete from %s", dbApi.quote(tableMeta.Name))
+	softDelete, values := softDeleteSet(dbApi, tableMeta, 1, confParams)
+	if len(softDelete) > 0 {
+		sql = fmt.Sprintf("update %s set %s", dbApi.quote(tableMeta.Name), softDelete)
+	}
+	if len(where) > 0 {
+		sql = fmt.Sprintf("%s where %s", sql, where)
+	}
+	res, err := session.Exec(append(append([]interface{}{sql + ";"}, values...), whereValues...)...)
+	if middleware.ProcessError(err) {
+		return -1, err
+	}
+	rowsAffected, err := checkAffectedRows(res)
+	if err != nil {
+		return rowsAffected, err
+	}
+	return rowsAffected, auditTableRows(session, dbApi, tableMeta, Delete, befores, confParams)
+}
+
+// 获取按条件操作的where条件, 条件为空时必须指定force
+func buildBulkWhere(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (string, []interface{}, error) {
+	where := ""
+	var values []interface{}
+	filter := make(map[string]interface{})
+	if whereValue, ok := requestJson["where"]; ok && whereValue != nil {
+		if filter, ok = whereValue.(map[string]interface{}); !ok {
+			return "", nil, errors.New("参数错误, where 必须为对象")
+		}
+		var err error
+		where, values, err = filterCondition(tableColumns(dbApi, tableMeta), filter, true)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if len(where) <= 0 {
+		if force, _ := requestJson["force"].(bool); !force {
+			return "", nil, errors.New("参数错误, 条件为空时必须指定 force 操作全表")
+		}
+	}
+	// where中未指定is_delete时不处理已删除数据
+	if isDelete := tableMeta.GetColumn("is_delete"); isDelete == nil || filter[isDelete.Name] == nil {
+		where = appendCondition(where, notDeletedCondition(dbApi, tableMeta, requestJson))
+	}
+	return where, values, nil
+}
+
+// 校验影响行数, 超过最大值时返回错误
+func checkAffectedRows(res sql.Result) (int64, error) {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if max := maxAffectedRows(); rowsAffected > int64(max) {
+		return rowsAffected, errors.New(fmt.Sprintf("影响行数 %d 超过最大值 %d, 操作已取消",
+			rowsAffected, max))
+	}
+	return rowsAffected, nil
+}
+
+// 按条件操作的最大影响行数
+func maxAffectedRows() int {
+	max, err := middleware.ConfInt(dbConfig(), "db.maxAffectedRows")
+	if err != nil || max <= 0 {
+		return defaultMaxAffectedRows
 	}
+	return max
+}
+
+// 构建update set语句
+//
+// 跳过主键, 自增列, 版本列及审计列, 审计列使用当前时间及请求人, 版本加1
+func buildUpdateSet(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{},
+	confParams map[string]string) (string, []interface{}) {
+
 	var values []interface{}
 	columnsStr := ""
-	for k, v := range requestJson {
+	audit := tableAudit(dbApi, tableMeta)
+	version := versionColumn(tableMeta)
+	for _, k := range sortedKeys(requestJson) {
+		v := requestJson[k]
 		if column := tableMeta.GetColumn(k); column != nil && !column.IsAutoIncrement {
-			if column.Name == "create_time" || column.Name == "update_time" {
+			if audit.isAuditColumn(column.Name) {
 				continue
 			}
-			if column.Name == primaryKey {
+			if version != nil && column.Name == version.Name {
+				continue
+			}
+			if isPrimaryKey(tableMeta, column.Name) {
 				continue
 			}
 			if len(columnsStr) > 0 {
-				columnsStr = fmt.Sprintf("%s, %s = ?", columnsStr, column.Name)
+				columnsStr = fmt.Sprintf("%s, %s = ?", columnsStr, dbApi.quote(column.Name))
 			} else {
-				columnsStr = fmt.Sprintf("%s = ?", column.Name)
+				columnsStr = fmt.Sprintf("%s = ?", dbApi.quote(column.Name))
 			}
 			if str, ok := v.(string); ok {
 				str = strings.TrimSpace(str)
@@ -169,144 +760,296 @@ func doUpdate(session xorm.Session, sqlConf SqlConf,
 			continue
 		}
 	}
-	if updateColumn := tableMeta.GetColumn("update_time"); updateColumn != nil {
-		columnsStr = fmt.Sprintf("%s, %s=now()", columnsStr, updateColumn.Name)
+	if len(columnsStr) <= 0 {
+		return "", nil
 	}
-	sql := fmt.Sprintf("update %s set %s where %s = ?;", tableMeta.Name,
-		columnsStr, primaryKey)
-	values = append(values, primaryValue)
-	res, err := session.Exec(append([]interface{}{sql}, values...)...)
-	if !middleware.ProcessError(err) {
-		return -1, err
-	} else {
-		return res.RowsAffected()
+	if auditSet, auditValues := audit.updateSet(dbApi, confParams); len(auditSet) > 0 {
+		columnsStr = fmt.Sprintf("%s, %s", columnsStr, auditSet)
+		values = append(values, auditValues...)
 	}
+	if version != nil {
+		quoted := dbApi.quote(version.Name)
+		columnsStr = fmt.Sprintf("%s, %s = %s + 1", columnsStr, quoted, quoted)
+	}
+	return columnsStr, values
 }
 
 // 执行查询操作
+//
+// 表中存在is_delete字段时默认不返回已删除数据, "includeDeleted" : true 时返回全部数据
 func doSelect(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
-	confParams map[string]string) ([]map[string]string, error) {
+	confParams map[string]string) ([]map[string]interface{}, error) {
 
-	tableMeta := dbApiInstance.GetMeta(sqlConf.Table)
-	if len(requestJson) <= 0 && len(confParams) <= 0 {
-		return session.QueryString(fmt.Sprintf("select * from %s;", tableMeta.Name))
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	requestJson = mergeConfParams(requestJson, confParams)
+	fields, err := buildFields(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
 	}
+	columnsStr, values, err := buildWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	columnsStr = appendCondition(columnsStr, notDeletedCondition(dbApi, tableMeta, requestJson))
 
-	var values []interface{}
-	columnsStr := ""
-	for k, v := range confParams { // 将配置写入到请求参数中
-		if postReg.MatchString(v) {
-			confMatch := postReg.FindAllStringSubmatch(v, -1)
-			requestJson[k] = confParams[confMatch[0][1]]
-		} else {
-			requestJson[k] = v
-		}
+	orderBySql, err := buildOrderBy(tableColumns(dbApi, tableMeta), requestJson["order"])
+	if err != nil {
+		return nil, err
 	}
 
-	orderBySql := ""
-	for k, v := range requestJson {
-		if column := tableMeta.GetColumn(k); column != nil && !column.IsAutoIncrement {
+	limitSql, err := buildLimit(requestJson)
+	if err != nil {
+		return nil, err
+	}
 
-			if len(columnsStr) > 0 {
-				if realValues, ok := v.([]interface{}); ok && len(realValues) > 0 {
-					rangeStr := ""
-					for range realValues {
-						rangeStr = fmt.Sprintf("%s, ?", rangeStr)
-					}
-					columnsStr = fmt.Sprintf("%s and %s in (%s)", columnsStr, column.Name, rangeStr[1:])
-					values = append(values, realValues...)
+	sql := selectSql(dbApi, tableMeta.Name, fields, columnsStr, orderBySql, limitSql)
+	res, err := queryRows(session, tableColumnTypes(tableMeta), dbApi.loc, append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return nil, err
+	}
+	return res, nil
+}
 
-				} else {
-					if v != nil {
-						columnsStr = fmt.Sprintf("%s and %s = ?", columnsStr, column.Name)
-						values = append(values, v)
-					}
-				}
+// 执行按主键查询操作, 返回单条数据
+//
+// 复合主键时所有主键都必须指定, 数据不存在时返回 ErrNotFound
+func doGet(session xorm.Session, sqlConf SqlConf,
+	requestJson map[string]interface{}) (map[string]interface{}, error) {
 
-			} else {
-				if realValues, ok := v.([]interface{}); ok && len(realValues) > 0 {
-					rangeStr := ""
-					for range realValues {
-						rangeStr = fmt.Sprintf("%s, ?", rangeStr)
-					}
-					columnsStr = fmt.Sprintf("%s in (%s)", column.Name, rangeStr[1:])
-					values = append(values, realValues...)
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	fields, err := buildFields(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	where, values, err := primaryCondition(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	where = appendCondition(where, notDeletedCondition(dbApi, tableMeta, requestJson))
+	sql := selectSql(dbApi, tableMeta.Name, fields, where, "", "")
+	rows, err := queryRows(session, tableColumnTypes(tableMeta), dbApi.loc, append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return nil, err
+	}
+	if len(rows) <= 0 {
+		return nil, ErrNotFound
+	}
+	return rows[0], nil
+}
 
-				} else {
-					if v != nil {
-						columnsStr = fmt.Sprintf("%s = ?", column.Name)
-						values = append(values, v)
-					}
-				}
+// 执行分页查询
+//
+// 页码模式: {"page" : 1, "size" : 20}, 返回总数及是否存在下一页
+//
+// 游标模式: {"cursor" : null, "size" : 20}, 按主键排序,
+// 使用上一页返回的cursor获取下一页, "cursorDesc" : true 时按主键倒序
+func doPage(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
+	confParams map[string]string) (*PageResult, error) {
 
-			}
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	requestJson = mergeConfParams(requestJson, confParams)
+	page, size, err := pageParams(requestJson)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := buildFields(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	columnsStr, values, err := buildWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	columnsStr = appendCondition(columnsStr, notDeletedCondition(dbApi, tableMeta, requestJson))
+	result := &PageResult{Size: size}
 
-			continue
+	if cursor, ok := requestJson["cursor"]; ok {
+		if len(tableMeta.PrimaryKeys) != 1 {
+			return nil, errors.New("游标分页只支持单一主键的表")
 		}
-		if k == "order" { // order by 处理
-			if v == nil {
-				continue
-			}
-			switch v.(type) {
-			case string:
-				orderBySql = fmt.Sprintf("%s %s %s desc", orderBySql, "order by", v.(string))
-				break
-			case map[string]interface{}:
-				/**
-				order : {
-					"key" : "asd",
-					"desc" : true | false,
-					"asc" : true | false
-				}
-				*/
-				orderBy := v.(map[string]interface{})
-				order, ok := orderBy["key"]
-				if !ok {
-					continue
-				}
-				descStr := "desc"
-				desc, ok := orderBy["desc"].(bool)
-				if ok && !desc {
-					descStr = "asc"
-				}
-				asc, ok := orderBy["asc"].(bool)
-				if ok && asc {
-					descStr = "asc"
-				}
-				orderBySql = fmt.Sprintf("%s %s %v %s", orderBySql, "order by", order, descStr)
-				break
+		primaryKey := tableMeta.PrimaryKeys[0]
+		quoted := dbApi.quote(primaryKey)
+		op, orderBySql := ">", fmt.Sprintf("order by %s asc", quoted)
+		if desc, _ := requestJson["cursorDesc"].(bool); desc {
+			op, orderBySql = "<", fmt.Sprintf("order by %s desc", quoted)
+		}
+		if cursor != nil {
+			if !isScalar(cursor) {
+				return nil, errors.New("参数错误, cursor 必须为单值")
 			}
+			columnsStr = appendCondition(columnsStr, fmt.Sprintf("%s %s ?", quoted, op))
+			values = append(values, cursor)
+		}
+		// 游标需要主键值
+		if fields != "*" && !containsColumn(fields, quoted) {
+			fields = fmt.Sprintf("%s, %s", fields, quoted)
 		}
+		// 多查询一条判断是否存在下一页
+		sql := selectSql(dbApi, tableMeta.Name, fields, columnsStr, orderBySql, fmt.Sprintf("limit %d", size+1))
+		rows, err := queryRows(session, tableColumnTypes(tableMeta), dbApi.loc, append([]interface{}{sql}, values...)...)
+		if middleware.ProcessError(err) {
+			return nil, err
+		}
+		if len(rows) > size {
+			result.HasMore = true
+			rows = rows[:size]
+		}
+		if len(rows) > 0 {
+			result.Cursor = rows[len(rows)-1][primaryKey]
+		}
+		result.Rows = rows
+		return result, nil
+	}
 
+	orderBySql, err := buildOrderBy(tableColumns(dbApi, tableMeta), requestJson["order"])
+	if err != nil {
+		return nil, err
 	}
+	total, err := countWhere(session, dbApi, tableMeta.Name, columnsStr, values)
+	if err != nil {
+		return nil, err
+	}
+	sql := selectSql(dbApi, tableMeta.Name, fields, columnsStr, orderBySql, limitSql((page-1)*size, size))
+	rows, err := queryRows(session, tableColumnTypes(tableMeta), dbApi.loc, append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return nil, err
+	}
+	result.Rows = rows
+	result.Page = page
+	result.Total = &total
+	result.HasMore = int64(page*size) < total
+	return result, nil
+}
 
-	// limit 处理
-	limitSql := ""
-	if start, ok := requestJson["start"]; ok {
-		limitSql = fmt.Sprintf("limit %s", start)
-		if size, ok := requestJson["size"]; ok {
-			limitSql = fmt.Sprintf("%s, %s", limitSql, size)
-		}
+// 执行统计操作
+//
+// 条件与查询操作一致, 默认不统计已删除数据
+func doCount(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
+	confParams map[string]string) (int64, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	requestJson = mergeConfParams(requestJson, confParams)
+	columnsStr, values, err := buildWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return -1, err
+	}
+	columnsStr = appendCondition(columnsStr, notDeletedCondition(dbApi, tableMeta, requestJson))
+	return countWhere(session, dbApi, tableMeta.Name, columnsStr, values)
+}
+
+// 执行聚合查询
+//
+// 过滤条件与统计操作一致, 聚合参数见 buildAggregate,
+// "having" 使用与过滤条件相同的格式, 参数名为分组列或聚合别名
+func doAggregate(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
+	confParams map[string]string) ([]map[string]interface{}, error) {
+
+	dbApi := GetDbApi(sqlConf.Datasource)
+	tableMeta := dbApi.GetMeta(sqlConf.Table)
+	requestJson = mergeConfParams(requestJson, confParams)
+	query, err := buildAggregate(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
+	}
+	columnsStr, values, err := buildWhere(dbApi, tableMeta, requestJson)
+	if err != nil {
+		return nil, err
 	}
+	columnsStr = appendCondition(columnsStr, notDeletedCondition(dbApi, tableMeta, requestJson))
 
-	sql := ""
-	if len(columnsStr) <= 0 {
-		sql = fmt.Sprintf("select * from %s", tableMeta.Name)
-	} else {
-		sql = fmt.Sprintf("select * from %s where %s", tableMeta.Name, columnsStr)
+	havingSql := ""
+	if having, ok := requestJson["having"]; ok && having != nil {
+		havingFilter, ok := having.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("参数错误, having 必须为对象")
+		}
+		havingStr, havingValues, err := filterCondition(query.resolve, havingFilter, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(havingStr) > 0 {
+			havingSql = fmt.Sprintf("having %s", havingStr)
+			values = append(values, havingValues...)
+		}
+	}
+	orderBySql, err := buildOrderBy(query.resolve, requestJson["order"])
+	if err != nil {
+		return nil, err
+	}
+	limitSql, err := buildLimit(requestJson)
+	if err != nil {
+		return nil, err
 	}
-	sql = fmt.Sprintf("%s %s %s;", sql, orderBySql, limitSql)
 
-	res, err := session.QueryString(append([]interface{}{sql}, values...)...)
-	if !middleware.ProcessError(err) {
-		return res, err
+	sql := fmt.Sprintf("select %s from %s", query.fields, dbApi.quote(tableMeta.Name))
+	if len(columnsStr) > 0 {
+		sql = fmt.Sprintf("%s where %s", sql, columnsStr)
+	}
+	sql = fmt.Sprintf("%s %s %s %s %s;", sql, query.groupBy, havingSql, orderBySql, limitSql)
+	res, err := queryRows(session, query.columnType, dbApi.loc, append([]interface{}{sql}, values...)...)
+	if middleware.ProcessError(err) {
+		return nil, err
 	}
 	return res, nil
 }
 
-// todo 执行统计操作
-func doCount(session xorm.Session, sqlConf SqlConf, requestJson map[string]interface{},
-	confParams map[string]string) ([]map[string]string, error) {
+// 按条件统计数量
+func countWhere(session xorm.Session, dbApi *DbApi, tableName string, columnsStr string,
+	values []interface{}) (int64, error) {
+
+	sql := fmt.Sprintf("select count(1) as total from %s", dbApi.quote(tableName))
+	if len(columnsStr) > 0 {
+		sql = fmt.Sprintf("%s where %s", sql, columnsStr)
+	}
+	res, err := session.QueryString(append([]interface{}{sql + ";"}, values...)...)
+	if middleware.ProcessError(err) {
+		return -1, err
+	}
+	if len(res) <= 0 {
+		return 0, nil
+	}
+	return strconv.ParseInt(res[0]["total"], 10, 64)
+}
+
+// 拼接查询语句
+func selectSql(dbApi *DbApi, tableName string, fields string, columnsStr string,
+	orderBySql string, limitSql string) string {
+
+	sql := fmt.Sprintf("select %s from %s", fields, dbApi.quote(tableName))
+	if len(columnsStr) > 0 {
+		sql = fmt.Sprintf("%s where %s", sql, columnsStr)
+	}
+	return fmt.Sprintf("%s %s %s;", sql, orderBySql, limitSql)
+}
+
+// 将配置参数写入到请求参数中
+func mergeConfParams(requestJson map[string]interface{},
+	confParams map[string]string) map[string]interface{} {
+
+	if requestJson == nil {
+		requestJson = make(map[string]interface{})
+	}
+	for k, v := range confParams {
+		if postReg.MatchString(v) {
+			confMatch := postReg.FindAllStringSubmatch(v, -1)
+			requestJson[k] = confParams[confMatch[0][1]]
+		} else {
+			requestJson[k] = v
+		}
+	}
+	return requestJson
+}
 
-	return nil, nil
+// 查询列中是否包含指定列
+func containsColumn(fields string, columnName string) bool {
+	for _, field := range strings.Split(fields, ", ") {
+		if field == columnName {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package dbrest
+
+// postgres 驱动, 使用 -tags postgres 编译时导入
+import _ "github.com/lib/pq"
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package dbrest
+
+// sqlite3 驱动, 使用 -tags sqlite 编译时导入, 需要开启cgo
+import _ "github.com/mattn/go-sqlite3"
@@ -60,7 +60,8 @@ func exec(session xorm.Session, sqlConf SqlConf,
 					rp.Value = confValue
 				}
 			} else {
-				if reqValue, ok := requestJson[p.Key]; ok {
+				// 保留参数不使用请求参数
+				if reqValue, ok := requestJson[p.Key]; ok && !isReservedParam(p.Key) {
 					rp.Value = fmt.Sprintf("%v", reqValue)
 				} else {
 					rp.Value = ""
@@ -84,8 +85,13 @@ func exec(session xorm.Session, sqlConf SqlConf,
 				} else {
 					pa.Value = confValue
 				}
+				// 保留参数为空时使用null
+				if isReservedParam(p.Key) && pa.Value == "" {
+					pa.Value = nil
+				}
 			} else {
-				if reqValue, ok := requestJson[p.Key]; ok {
+				// 保留参数不使用请求参数
+				if reqValue, ok := requestJson[p.Key]; ok && !isReservedParam(p.Key) {
 					pa.Value = reqValue
 				} else {
 					pa.Value = nil
@@ -95,10 +101,23 @@ func exec(session xorm.Session, sqlConf SqlConf,
 		}
 	}
 	if strings.HasPrefix(strings.ToUpper(sql), "SELECT") {
-		return session.QueryString(append([]interface{}{sql}, variable...)...)
+		// 配置了table时按表的列类型转换结果
+		dbApi := GetDbApi(sqlConf.Datasource)
+		var types columnTypes
+		if len(sqlConf.Table) > 0 {
+			if tableMeta, ok := dbApi.metas()[sqlConf.Table]; ok {
+				types = tableColumnTypes(tableMeta)
+			}
+		}
+		return queryRows(session, types, dbApi.loc, append([]interface{}{sql}, variable...)...)
 
 	} else {
-		return session.Exec(append([]interface{}{sql}, variable...)...)
+		res, err := session.Exec(append([]interface{}{sql}, variable...)...)
+		if err != nil {
+			return res, err
+		}
+		// 自定义sql记录sql语句及参数值
+		return res, writeSqlAuditLog(session, sqlConf.Table, sql, variable, confParams)
 	}
 }
 
@@ -0,0 +1,69 @@
+package dbrest
+
+import (
+	"database/sql"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"sync/atomic"
+)
+
+// 连接池配置, 命名数据源使用 db.<name>.<key>, 未配置时使用驱动默认值
+//
+// {
+// 	"db.maxOpenConns" : 100,
+// 	"db.maxIdleConns" : 10,
+// 	"db.connMaxLifetime" : "30m"
+// }
+//
+// connMaxLifetime 支持 30s, 5m 等格式, 纯数字时单位为秒
+func configurePool(name string, orm *xorm.Engine) error {
+	if maxOpenConns, err := middleware.ConfInt(dbConfig(), datasourceKey(name, "maxOpenConns")); err == nil && maxOpenConns > 0 {
+		orm.SetMaxOpenConns(maxOpenConns)
+	}
+	if maxIdleConns, err := middleware.ConfInt(dbConfig(), datasourceKey(name, "maxIdleConns")); err == nil && maxIdleConns > 0 {
+		orm.SetMaxIdleConns(maxIdleConns)
+	}
+	if connMaxLifetime := datasourceConf(name, "connMaxLifetime"); len(connMaxLifetime) > 0 {
+		duration, err := parseDuration(connMaxLifetime)
+		if err != nil {
+			return err
+		}
+		orm.SetConnMaxLifetime(duration)
+	}
+	return nil
+}
+
+// 从库连接池状态
+type replicaStats struct {
+	Healthy bool        `json:"healthy"`
+	Stats   sql.DBStats `json:"stats"`
+}
+
+// 连接池状态
+type poolStats struct {
+	Primary  sql.DBStats             `json:"primary"`
+	Replicas map[string]replicaStats `json:"replicas"`
+}
+
+// 获取主库及从库的连接池状态
+func (this *DbApi) poolStats() poolStats {
+	res := poolStats{
+		Primary:  this.orm.DB().Stats(),
+		Replicas: make(map[string]replicaStats),
+	}
+	for _, r := range this.replicas {
+		res.Replicas[r.addr] = replicaStats{
+			Healthy: atomic.LoadInt32(&r.healthy) == 1,
+			Stats:   r.orm.DB().Stats(),
+		}
+	}
+	return res
+}
+
+// 注册连接池状态接口
+func registerPoolStats(dbApi *DbApi) {
+	registerDatasourceRoute(dbApi, "/pool", func(context middleware.Context, dbApi *DbApi) {
+		_ = context.ApiResponse(0, "", dbApi.poolStats())
+		return
+	})
+}
@@ -0,0 +1,410 @@
+package dbrest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/wenlaizhou/middleware"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 构建order by语句
+//
+// 排序列必须为表中存在的列, 支持以下格式:
+//
+// "order" : "create_time"
+//
+// "order" : {"key" : "create_time", "desc" : true}
+//
+// "order" : [
+// 	{"key" : "level", "desc" : true, "nulls" : "last"},
+// 	{"key" : "name", "asc" : true}
+// ]
+func buildOrderBy(resolve columnResolver, v interface{}) (string, error) {
+	var orders []interface{}
+	switch realValue := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		orders = realValue
+		break
+	default:
+		orders = []interface{}{realValue}
+		break
+	}
+	orderItems := make([]string, 0, len(orders))
+	for _, order := range orders {
+		items, err := orderItem(resolve, order)
+		if err != nil {
+			return "", err
+		}
+		orderItems = append(orderItems, items...)
+	}
+	if len(orderItems) <= 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("order by %s", strings.Join(orderItems, ", ")), nil
+}
+
+// 单个排序项, 默认倒序
+//
+// mysql不支持nulls first/last, 使用 is null 排序模拟, 各数据库通用
+func orderItem(resolve columnResolver, order interface{}) ([]string, error) {
+	key := ""
+	descStr := "desc"
+	nulls := ""
+	switch realValue := order.(type) {
+	case string:
+		key = realValue
+		break
+	case map[string]interface{}:
+		/**
+		order : {
+			"key" : "asd",
+			"desc" : true | false,
+			"asc" : true | false,
+			"nulls" : "first" | "last"
+		}
+		*/
+		key, _ = realValue["key"].(string)
+		desc, ok := realValue["desc"].(bool)
+		if ok && !desc {
+			descStr = "asc"
+		}
+		asc, ok := realValue["asc"].(bool)
+		if ok && asc {
+			descStr = "asc"
+		}
+		if nullsValue, ok := realValue["nulls"]; ok && nullsValue != nil {
+			nulls, _ = nullsValue.(string)
+			if nulls != "first" && nulls != "last" {
+				return nil, errors.New(fmt.Sprintf("参数错误, 排序 nulls 只支持 first 或 last: %v", nullsValue))
+			}
+		}
+		break
+	default:
+		return nil, errors.New(fmt.Sprintf("参数错误, 不支持的排序格式: %v", order))
+	}
+	columnName, ok := resolve(key)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("参数错误, 排序列 %s 不存在", key))
+	}
+	items := make([]string, 0, 2)
+	switch nulls {
+	case "first":
+		items = append(items, fmt.Sprintf("%s is null desc", columnName))
+		break
+	case "last":
+		items = append(items, fmt.Sprintf("%s is null asc", columnName))
+		break
+	}
+	return append(items, fmt.Sprintf("%s %s", columnName, descStr)), nil
+}
+
+// 默认分页大小
+const defaultPageSize = 20
+
+// 默认最大分页大小, 可通过 db.maxPageSize 配置
+const defaultMaxPageSize = 1000
+
+// 分页查询最大偏移量, 避免 (page-1)*size 溢出
+const maxPageOffset = math.MaxInt32
+
+// 分页查询结果
+type PageResult struct {
+	Rows    []map[string]interface{} `json:"rows"`
+	Total   *int64                   `json:"total,omitempty"` // 游标分页不统计总数
+	Page    int                      `json:"page,omitempty"`
+	Size    int                      `json:"size"`
+	HasMore bool                     `json:"hasMore"`
+	Cursor  interface{}              `json:"cursor,omitempty"` // 下一页游标
+}
+
+// 是否为分页查询
+func isPageQuery(requestJson map[string]interface{}) bool {
+	if _, ok := requestJson["page"]; ok {
+		return true
+	}
+	_, ok := requestJson["cursor"]
+	return ok
+}
+
+// 获取最大分页大小
+func maxPageSize() int {
+	size, err := middleware.ConfInt(dbConfig(), "db.maxPageSize")
+	if err != nil || size <= 0 {
+		return defaultMaxPageSize
+	}
+	return size
+}
+
+// 构建limit语句
+//
+// "start" : 0, "size" : 10 => limit 10 offset 0
+//
+// 只有start时与原有行为一致 => limit start
+func buildLimit(requestJson map[string]interface{}) (string, error) {
+	startValue, ok := requestJson["start"]
+	if !ok {
+		return "", nil
+	}
+	start, err := intParam("start", startValue, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	sizeValue, ok := requestJson["size"]
+	if !ok {
+		if start > maxPageSize() {
+			return "", errors.New(fmt.Sprintf("参数错误, start 不能超过 %d", maxPageSize()))
+		}
+		return fmt.Sprintf("limit %d", start), nil
+	}
+	size, err := intParam("size", sizeValue, 1, maxPageSize())
+	if err != nil {
+		return "", err
+	}
+	return limitSql(start, size), nil
+}
+
+// 获取分页参数, 页码从1开始
+func pageParams(requestJson map[string]interface{}) (int, int, error) {
+	page := 1
+	size := defaultPageSize
+	var err error
+	if v, ok := requestJson["page"]; ok && v != nil {
+		if page, err = intParam("page", v, 1, -1); err != nil {
+			return 0, 0, err
+		}
+	}
+	if v, ok := requestJson["size"]; ok && v != nil {
+		if size, err = intParam("size", v, 1, maxPageSize()); err != nil {
+			return 0, 0, err
+		}
+	}
+	if maxPage := maxPageOffset/size + 1; page > maxPage {
+		return 0, 0, errors.New(fmt.Sprintf("参数错误, page 不能超过 %d", maxPage))
+	}
+	return page, size, nil
+}
+
+// 数值参数校验, max小于0时不限制最大值
+func intParam(name string, v interface{}, min int, max int) (int, error) {
+	var res int
+	switch realValue := v.(type) {
+	case float64:
+		if realValue != float64(int(realValue)) {
+			return 0, errors.New(fmt.Sprintf("参数错误, %s 必须为整数", name))
+		}
+		res = int(realValue)
+		break
+	case string:
+		parsed, err := strconv.Atoi(strings.TrimSpace(realValue))
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("参数错误, %s 必须为整数", name))
+		}
+		res = parsed
+		break
+	default:
+		return 0, errors.New(fmt.Sprintf("参数错误, %s 必须为整数", name))
+	}
+	if res < min {
+		return 0, errors.New(fmt.Sprintf("参数错误, %s 不能小于 %d", name, min))
+	}
+	if max >= 0 && res > max {
+		return 0, errors.New(fmt.Sprintf("参数错误, %s 不能超过 %d", name, max))
+	}
+	return res, nil
+}
+
+// 构建查询列
+//
+// "fields" : ["id", "name"] 或 "id,name", 只查询指定列
+//
+// "exclude" : ["content"] 或 "content", 查询除指定列外的所有列
+//
+// 表中有隐藏列时不使用 *, 只查询可见的列
+func buildFields(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (string, error) {
+	fields, err := columnNames(dbApi, tableMeta, "fields", requestJson["fields"])
+	if err != nil {
+		return "", err
+	}
+	exclude, err := columnNames(dbApi, tableMeta, "exclude", requestJson["exclude"])
+	if err != nil {
+		return "", err
+	}
+	if len(fields) <= 0 && len(exclude) <= 0 && len(dbApi.hiddenColumns(tableMeta.Name)) <= 0 {
+		return "*", nil
+	}
+	if len(fields) <= 0 {
+		for _, column := range dbApi.visibleColumns(tableMeta) {
+			fields = append(fields, column.Name)
+		}
+	}
+	excludeSet := make(map[string]bool)
+	for _, name := range exclude {
+		excludeSet[name] = true
+	}
+	selected := make([]string, 0, len(fields))
+	for _, name := range fields {
+		if !excludeSet[name] {
+			selected = append(selected, name)
+		}
+	}
+	if len(selected) <= 0 {
+		return "", errors.New("参数错误, 没有需要查询的列")
+	}
+	return dbApi.quoteColumns(selected), nil
+}
+
+// 解析列名参数, 支持数组及逗号分隔字符串, 列必须存在且不是隐藏列
+func columnNames(dbApi *DbApi, tableMeta core.Table, name string, v interface{}) ([]string, error) {
+	var names []string
+	switch realValue := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		for _, item := range strings.Split(realValue, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				names = append(names, item)
+			}
+		}
+		break
+	case []interface{}:
+		for _, item := range realValue {
+			itemStr, ok := item.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("参数错误, %s 必须为列名数组", name))
+			}
+			names = append(names, itemStr)
+		}
+		break
+	default:
+		return nil, errors.New(fmt.Sprintf("参数错误, %s 必须为列名数组", name))
+	}
+	res := make([]string, 0, len(names))
+	for _, item := range names {
+		column := dbApi.visibleColumn(tableMeta, item)
+		if column == nil {
+			return nil, errors.New(fmt.Sprintf("参数错误, %s 中的列 %s 不存在", name, item))
+		}
+		res = append(res, column.Name)
+	}
+	return res, nil
+}
+
+// 聚合函数
+var aggregateFuncs = map[string]string{
+	"count":          "count(%s)",
+	"sum":            "sum(%s)",
+	"avg":            "avg(%s)",
+	"min":            "min(%s)",
+	"max":            "max(%s)",
+	"countDistinct":  "count(distinct %s)",
+	"count distinct": "count(distinct %s)",
+}
+
+var aliasReg = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// 聚合查询参数
+type aggregateQuery struct {
+	fields      string
+	groupBy     string
+	expressions map[string]string       // 分组列及聚合别名对应的sql表达式
+	columns     map[string]*core.Column // 结果列类型
+}
+
+// 解析having及排序中的分组列或聚合别名
+func (this *aggregateQuery) resolve(key string) (string, bool) {
+	expression, ok := this.expressions[key]
+	return expression, ok
+}
+
+// 获取结果列类型
+func (this *aggregateQuery) columnType(name string) *core.Column {
+	return this.columns[name]
+}
+
+// 构建聚合查询列及group by语句
+//
+// {
+// 	"groupBy" : ["status"],
+// 	"aggregates" : [
+// 		{"func" : "count", "column" : "*", "as" : "total"},
+// 		{"func" : "sum", "column" : "amount"},
+// 		{"func" : "countDistinct", "column" : "owner", "as" : "owners"}
+// 	]
+// }
+//
+// 未指定别名时使用 func_column
+func buildAggregate(dbApi *DbApi, tableMeta core.Table, requestJson map[string]interface{}) (*aggregateQuery, error) {
+	groupBy, err := columnNames(dbApi, tableMeta, "groupBy", requestJson["groupBy"])
+	if err != nil {
+		return nil, err
+	}
+	aggregates, ok := requestJson["aggregates"].([]interface{})
+	if !ok || len(aggregates) <= 0 {
+		return nil, errors.New("参数错误, aggregates 必须为非空数组")
+	}
+
+	query := &aggregateQuery{
+		expressions: make(map[string]string),
+		columns:     make(map[string]*core.Column),
+	}
+	fields := make([]string, 0, len(groupBy)+len(aggregates))
+	for _, columnName := range groupBy {
+		query.expressions[columnName] = dbApi.quote(columnName)
+		query.columns[columnName] = tableMeta.GetColumn(columnName)
+		fields = append(fields, dbApi.quote(columnName))
+	}
+	for _, aggregate := range aggregates {
+		spec, ok := aggregate.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("参数错误, aggregates 的元素必须为对象")
+		}
+		funcName, _ := spec["func"].(string)
+		funcFormat, ok := aggregateFuncs[funcName]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("参数错误, 不支持的聚合函数 %s", funcName))
+		}
+		var column *core.Column
+		columnName, _ := spec["column"].(string)
+		argument := "*"
+		if columnName == "*" || len(columnName) <= 0 {
+			if funcName != "count" {
+				return nil, errors.New(fmt.Sprintf("参数错误, 聚合函数 %s 必须指定列", funcName))
+			}
+			columnName = "*"
+		} else {
+			column = dbApi.visibleColumn(tableMeta, columnName)
+			if column == nil {
+				return nil, errors.New(fmt.Sprintf("参数错误, 聚合列 %s 不存在", columnName))
+			}
+			columnName = column.Name
+			argument = dbApi.quote(columnName)
+		}
+		alias, _ := spec["as"].(string)
+		if len(alias) <= 0 {
+			alias = strings.Replace(fmt.Sprintf("%s_%s", funcName, columnName), " ", "_", -1)
+			alias = strings.Replace(alias, "*", "all", -1)
+		}
+		if !aliasReg.MatchString(alias) {
+			return nil, errors.New(fmt.Sprintf("参数错误, 非法的别名 %s", alias))
+		}
+		if _, ok := query.expressions[alias]; ok {
+			return nil, errors.New(fmt.Sprintf("参数错误, 别名 %s 重复", alias))
+		}
+		expression := fmt.Sprintf(funcFormat, argument)
+		query.expressions[alias] = expression
+		query.columns[alias] = aggregateColumn(funcName, column)
+		fields = append(fields, fmt.Sprintf("%s as %s", expression, dbApi.quote(alias)))
+	}
+
+	query.fields = strings.Join(fields, ", ")
+	if len(groupBy) > 0 {
+		query.groupBy = fmt.Sprintf("group by %s", dbApi.quoteColumns(groupBy))
+	}
+	return query, nil
+}
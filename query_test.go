@@ -0,0 +1,99 @@
+package dbrest
+
+import (
+	"github.com/wenlaizhou/middleware"
+	"testing"
+)
+
+func TestBuildOrderBy(t *testing.T) {
+	dbApi := testDbApi(t, middleware.Config{"db.table.user.hiddenColumns": "password"})
+	resolve := tableColumns(dbApi, testTable())
+	cases := []struct {
+		name  string
+		order interface{}
+		sql   string
+		ok    bool
+	}{
+		{"none", nil, "", true},
+		{"column", "age", "order by `age` desc", true},
+		{"asc", map[string]interface{}{"key": "age", "asc": true}, "order by `age` asc", true},
+		{"desc false", map[string]interface{}{"key": "age", "desc": false}, "order by `age` asc", true},
+		{"multiple", []interface{}{
+			map[string]interface{}{"key": "age", "desc": true, "nulls": "last"},
+			map[string]interface{}{"key": "name", "asc": true}},
+			"order by `age` is null asc, `age` desc, `name` asc", true},
+		{"nulls first", map[string]interface{}{"key": "name", "nulls": "first"}, "order by `name` is null desc, `name` desc", true},
+		{"empty array", []interface{}{}, "", true},
+		{"unknown column", "nickname", "", false},
+		{"hidden column", "password", "", false},
+		{"missing key", map[string]interface{}{"desc": true}, "", false},
+		{"bad nulls", map[string]interface{}{"key": "age", "nulls": "middle"}, "", false},
+		{"bad format", 1.0, "", false},
+		// 排序列只能为表中的列, 拒绝注入
+		{"injected expression", "age; drop table user", "", false},
+		{"injected direction", "age desc, (select 1)", "", false},
+		{"injected key", map[string]interface{}{"key": "if(1=1, age, name)"}, "", false},
+		{"injected in array", []interface{}{"age", "sleep(10)"}, "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sql, err := buildOrderBy(resolve, c.order)
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("期望返回错误, 实际 %s", sql)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != c.sql {
+				t.Fatalf("期望 %s, 实际 %s", c.sql, sql)
+			}
+		})
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	testDbApi(t, middleware.Config{"db.maxPageSize": "100"})
+	cases := []struct {
+		name        string
+		requestJson map[string]interface{}
+		page        int
+		size        int
+		ok          bool
+	}{
+		{"default", map[string]interface{}{}, 1, defaultPageSize, true},
+		{"null", map[string]interface{}{"page": nil, "size": nil}, 1, defaultPageSize, true},
+		{"number", map[string]interface{}{"page": 3.0, "size": 50.0}, 3, 50, true},
+		{"string", map[string]interface{}{"page": " 2 ", "size": "10"}, 2, 10, true},
+		{"zero page", map[string]interface{}{"page": 0.0}, 0, 0, false},
+		{"negative page", map[string]interface{}{"page": -1.0}, 0, 0, false},
+		{"decimal page", map[string]interface{}{"page": 1.5}, 0, 0, false},
+		{"bad page", map[string]interface{}{"page": "a"}, 0, 0, false},
+		{"zero size", map[string]interface{}{"size": 0.0}, 0, 0, false},
+		{"max size", map[string]interface{}{"size": 100.0}, 1, 100, true},
+		{"size over max", map[string]interface{}{"size": 101.0}, 0, 0, false},
+		// 偏移量不能溢出
+		{"max page", map[string]interface{}{"page": float64(maxPageOffset/10 + 1), "size": 10.0}, maxPageOffset/10 + 1, 10, true},
+		{"page over max", map[string]interface{}{"page": float64(maxPageOffset/10 + 2), "size": 10.0}, 0, 0, false},
+		{"overflow page", map[string]interface{}{"page": "9223372036854775807", "size": 100.0}, 0, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			page, size, err := pageParams(c.requestJson)
+			if !c.ok {
+				if err == nil {
+					t.Fatalf("期望返回错误, 实际 page %d size %d", page, size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page != c.page || size != c.size {
+				t.Fatalf("期望 page %d size %d, 实际 page %d size %d", c.page, c.size, page, size)
+			}
+		})
+	}
+}
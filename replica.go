@@ -0,0 +1,163 @@
+package dbrest
+
+import (
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 默认从库健康检查间隔, 可通过 db.replicaCheckInterval 配置, 单位秒
+const defaultReplicaCheckInterval = 10
+
+// 从库
+type replica struct {
+	addr    string
+	orm     *xorm.Engine
+	healthy int32
+}
+
+// 初始化从库
+//
+// db.replicas 配置从库地址列表, 使用,分割, 例如: "10.0.0.2:3306, 10.0.0.3:3306"
+//
+// 命名数据源使用 db.<name>.replicas 配置, 从库与主库使用相同的驱动, 用户, 密码, 数据库及连接池配置
+//
+// 查询按轮询方式使用健康的从库, 没有健康的从库时使用主库
+func (this *DbApi) initReplicas() {
+	if this.driver == DriverSqlite {
+		return
+	}
+	for _, addr := range strings.Split(datasourceConf(this.name, "replicas"), ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) <= 0 {
+			continue
+		}
+		host, port := addr, this.port
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			host = h
+			if port, err = strconv.Atoi(p); err != nil {
+				Logger.ErrorF("从库地址错误 %s", addr)
+				continue
+			}
+		}
+		datasource, err := dataSourceName(this.name, this.driver, host, port, this.user, this.password, this.db)
+		if middleware.ProcessError(err) {
+			continue
+		}
+		orm, err := xorm.NewEngine(this.driver, datasource)
+		if err != nil {
+			Logger.ErrorF("从库连接错误 %s: %s", addr, err.Error())
+			continue
+		}
+		orm.ShowSQL(true)
+		if err = configurePool(this.name, orm); err != nil {
+			Logger.ErrorF("从库连接池配置错误 %s: %s", addr, err.Error())
+			_ = orm.Close()
+			continue
+		}
+		this.replicas = append(this.replicas, &replica{
+			addr:    addr,
+			orm:     orm,
+			healthy: 1,
+		})
+	}
+	if len(this.replicas) <= 0 {
+		return
+	}
+	this.replicaDone = make(chan struct{})
+	go this.checkReplicas(this.replicaDone)
+}
+
+// 定时检查从库健康状态
+func (this *DbApi) checkReplicas(done chan struct{}) {
+	interval, err := middleware.ConfInt(dbConfig(), "db.replicaCheckInterval")
+	if err != nil || interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, r := range this.replicas {
+				var healthy int32 = 1
+				if err := r.orm.Ping(); err != nil {
+					Logger.ErrorF("从库 %s 不可用: %s", r.addr, err.Error())
+					healthy = 0
+				}
+				atomic.StoreInt32(&r.healthy, healthy)
+			}
+		}
+	}
+}
+
+// 停止从库健康检查
+func (this *DbApi) stopReplicas() {
+	if this.replicaDone != nil {
+		close(this.replicaDone)
+		this.replicaDone = nil
+	}
+}
+
+// 获取查询使用的数据库引擎, consistent 为true或没有健康的从库时使用主库
+func (this *DbApi) readEngine(consistent bool) *xorm.Engine {
+	if consistent || len(this.replicas) <= 0 {
+		return this.orm
+	}
+	start := atomic.AddUint32(&this.replicaNext, 1)
+	for i := 0; i < len(this.replicas); i++ {
+		r := this.replicas[(int(start)+i)%len(this.replicas)]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.orm
+		}
+	}
+	return this.orm
+}
+
+// 创建查询会话
+func (this *DbApi) readSession(consistent bool) *xorm.Session {
+	return this.readEngine(consistent).NewSession()
+}
+
+// 是否要求一致性读, 请求参数或查询参数中 "consistent" : true 时查询主库
+func consistentRead(context middleware.Context, params map[string]interface{}) bool {
+	if consistent, ok := params["consistent"].(bool); ok {
+		return consistent
+	}
+	return context.Request.URL.Query().Get("consistent") == "true"
+}
+
+// 是否为只读sql
+func isReadSql(sql string) bool {
+	fields := strings.Fields(strings.ToUpper(sql))
+	if len(fields) <= 0 {
+		return false
+	}
+	switch fields[0] {
+	case "SELECT", "SHOW", "EXPLAIN", "DESC", "DESCRIBE":
+		return true
+	}
+	return false
+}
+
+// sql配置是否只包含查询
+func (this SqlApi) readOnly() bool {
+	if this.Transaction {
+		return false
+	}
+	for _, sqlConf := range this.Sqls {
+		if sqlConf.HasSql && !isReadSql(sqlConf.SqlOrigin) {
+			return false
+		}
+		if !sqlConf.HasSql && sqlConf.Type != Select && sqlConf.Type != Count {
+			return false
+		}
+	}
+	return true
+}
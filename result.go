@@ -0,0 +1,292 @@
+package dbrest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 根据列名获取列信息, 不存在时返回nil
+type columnTypes func(name string) *core.Column
+
+// 使用表的列信息
+func tableColumnTypes(tableMeta core.Table) columnTypes {
+	return func(name string) *core.Column {
+		return tableMeta.GetColumn(name)
+	}
+}
+
+// 是否返回类型化结果
+//
+// db.typedResult 配置为false时与原有行为一致, 所有值均为字符串, NULL为空字符串
+func typedResult() bool {
+	return strings.TrimSpace(middleware.ConfUnsafe(dbConfig(), "db.typedResult")) != "false"
+}
+
+// 执行查询, 并根据列类型转换结果
+//
+// 数值返回json数字, NULL返回null, tinyint(1)返回布尔值, 时间返回RFC3339格式
+//
+// 没有列信息时根据驱动返回值类型转换
+func queryRows(session xorm.Session, types columnTypes, loc *time.Location,
+	sqlOrArgs ...interface{}) ([]map[string]interface{}, error) {
+
+	if !typedResult() {
+		rows, err := session.QueryString(sqlOrArgs...)
+		if err != nil {
+			return nil, err
+		}
+		return stringRows(rows), nil
+	}
+	rows, err := session.QueryInterface(sqlOrArgs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for k, v := range row {
+			var column *core.Column
+			if types != nil {
+				column = types(k)
+			}
+			row[k] = typedValue(v, column, loc)
+		}
+	}
+	return rows, nil
+}
+
+// 执行没有表结构的查询, 根据结果集的列类型转换结果, 用于sql接口
+//
+// db.typedResult 配置为false时与 queryRows 一致
+func queryResultRows(db *sql.DB, loc *time.Location, sqlStr string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	resultTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]*core.Column, 0, len(resultTypes))
+	for _, resultType := range resultTypes {
+		columns = append(columns, resultColumn(resultType))
+	}
+	res := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		scans := make([]interface{}, len(columns))
+		for i := range values {
+			scans[i] = &values[i]
+		}
+		if err = rows.Scan(scans...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if typedResult() {
+				row[column.Name] = typedValue(values[i], column, loc)
+			} else {
+				row[column.Name] = untypedValue(values[i])
+			}
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// 结果集列类型转换为列信息, 兼容 postgres 的类型名称
+func resultColumn(resultType *sql.ColumnType) *core.Column {
+	// mysql 无符号整数为 UNSIGNED INT 等
+	typeName := strings.TrimPrefix(strings.ToUpper(resultType.DatabaseTypeName()), "UNSIGNED ")
+	switch typeName {
+	case "INT2":
+		typeName = core.SmallInt
+	case "INT4":
+		typeName = core.Int
+	case "INT8":
+		typeName = core.BigInt
+	case "FLOAT4":
+		typeName = core.Real
+	case "FLOAT8":
+		typeName = core.Double
+	case "BOOL":
+		typeName = core.Bool
+	case "TIMESTAMPTZ":
+		typeName = core.TimeStampz
+	}
+	column := &core.Column{
+		Name:    resultType.Name(),
+		SQLType: core.SQLType{Name: typeName},
+	}
+	if length, ok := resultType.Length(); ok {
+		column.Length = int(length)
+	}
+	return column
+}
+
+// 不转换类型时的值, 与 QueryString 一致, NULL为空字符串
+func untypedValue(v interface{}) interface{} {
+	switch realValue := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(realValue)
+	case string:
+		return realValue
+	case time.Time:
+		return realValue.Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// 类型化结果转换为字符串结果
+//
+// db.typedResult 配置为false时与原有行为一致, 否则数值及布尔值转为字符串, 时间为RFC3339格式
+func untypedRows(rows []map[string]interface{}) []map[string]string {
+	res := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		stringRow := make(map[string]string, len(row))
+		for k, v := range row {
+			stringRow[k] = untypedString(v)
+		}
+		res = append(res, stringRow)
+	}
+	return res
+}
+
+// 单值转换为字符串, NULL为空字符串
+func untypedString(v interface{}) string {
+	switch realValue := v.(type) {
+	case bool:
+		return strconv.FormatBool(realValue)
+	case float64:
+		return strconv.FormatFloat(realValue, 'f', -1, 64)
+	}
+	return untypedValue(v).(string)
+}
+
+// 字符串结果转换
+func stringRows(rows []map[string]string) []map[string]interface{} {
+	res := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, stringRow(row))
+	}
+	return res
+}
+
+func stringRow(row map[string]string) map[string]interface{} {
+	res := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		res[k] = v
+	}
+	return res
+}
+
+// 单值转换, 不带时区的时间值按 loc 解析
+func typedValue(v interface{}, column *core.Column, loc *time.Location) interface{} {
+	switch realValue := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		if column == nil {
+			return string(realValue)
+		}
+		return typedString(string(realValue), column, loc)
+	case string:
+		if column == nil {
+			return realValue
+		}
+		return typedString(realValue, column, loc)
+	case time.Time:
+		return realValue.Format(time.RFC3339)
+	case int64:
+		if column != nil && isBoolColumn(column) {
+			return realValue != 0
+		}
+		return realValue
+	default:
+		return v
+	}
+}
+
+// 根据列类型转换字符串值, 无法转换时返回原值
+func typedString(str string, column *core.Column, loc *time.Location) interface{} {
+	if isBoolColumn(column) {
+		// bit(1) 返回原始字节
+		if len(str) == 1 && str[0] <= 1 {
+			return str[0] == 1
+		}
+		if parsed, err := strconv.ParseBool(str); err == nil {
+			return parsed
+		}
+		return str
+	}
+	switch sqlTypeName(column) {
+	case core.TinyInt, core.SmallInt, core.MediumInt, core.Int, core.Integer, core.BigInt,
+		core.Serial, core.BigSerial:
+		if parsed, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return parsed
+		}
+		if parsed, err := strconv.ParseUint(str, 10, 64); err == nil {
+			return parsed
+		}
+		return str
+	case core.Decimal, core.Numeric, core.Money, core.SmallMoney:
+		// 保留精度
+		if _, err := strconv.ParseFloat(str, 64); err == nil {
+			return json.Number(str)
+		}
+		return str
+	case core.Float, core.Double, core.Real:
+		if parsed, err := strconv.ParseFloat(str, 64); err == nil {
+			return parsed
+		}
+		return str
+	case core.DateTime, core.TimeStamp, core.TimeStampz:
+		if loc == nil {
+			loc = time.Local
+		}
+		if parsed, err := time.ParseInLocation("2006-01-02 15:04:05", str, loc); err == nil {
+			return parsed.Format(time.RFC3339)
+		}
+		return str
+	}
+	return str
+}
+
+// 是否为布尔类型列, 包括 tinyint(1)
+func isBoolColumn(column *core.Column) bool {
+	switch sqlTypeName(column) {
+	case core.Bool, core.Boolean:
+		return true
+	case core.TinyInt, core.Bit:
+		return column.Length == 1 || column.SQLType.DefaultLength == 1
+	}
+	return false
+}
+
+// 列类型名称, 去除 unsigned 等修饰
+func sqlTypeName(column *core.Column) string {
+	fields := strings.Fields(strings.ToUpper(column.SQLType.Name))
+	if len(fields) <= 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// 聚合结果的列类型, 统计为整数, 求和及平均值为小数, 最大最小值与原列一致
+func aggregateColumn(funcName string, column *core.Column) *core.Column {
+	switch funcName {
+	case "count", "countDistinct", "count distinct":
+		return &core.Column{SQLType: core.SQLType{Name: core.BigInt}}
+	case "sum", "avg":
+		return &core.Column{SQLType: core.SQLType{Name: core.Decimal}}
+	}
+	return column
+}
@@ -0,0 +1,229 @@
+package dbrest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-xorm/core"
+	"github.com/wenlaizhou/middleware"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 已注册的接口路径, 同一路径只注册一次
+//
+// 接口处理时按名称获取当前的数据源及表结构, 重新初始化或重新加载表结构后不需要重复注册
+var registeredRoutes = make(map[string]func(context middleware.Context))
+
+var routesLock = new(sync.Mutex)
+
+// 表结构变化
+type schemaDiff struct {
+	Added   []string `json:"added"`
+	Dropped []string `json:"dropped"`
+	Changed []string `json:"changed"`
+}
+
+// 注册接口, 已注册的路径忽略, 处理前认证
+func registerRoute(path string, handler func(context middleware.Context)) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+	if _, ok := registeredRoutes[path]; ok {
+		return
+	}
+	registeredRoutes[path] = authHandler(handler)
+	middleware.RegisterHandler(path, registeredRoutes[path])
+}
+
+// 获取已注册接口的处理函数, 包括认证, 未注册时返回nil
+func routeHandler(path string) func(context middleware.Context) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+	return registeredRoutes[path]
+}
+
+// 注册数据源接口, 处理时使用当前的数据源
+func registerDatasourceRoute(dbApi *DbApi, path string,
+	handler func(context middleware.Context, dbApi *DbApi)) {
+
+	name := dbApi.name
+	registerRoute(dbApi.path(path), func(context middleware.Context) {
+		current := GetDbApi(name)
+		if current == nil {
+			_ = context.ApiResponse(-1, fmt.Sprintf("数据源 %s 不存在", name), nil)
+			return
+		}
+		handler(context, current)
+	})
+}
+
+// 注册表接口, 处理时使用当前的表结构, 表已删除或不开放时返回不存在
+//
+// path 为操作名, 为空时为 GET <table>/<id>, 对应 get 操作
+func registerTableRoute(dbApi *DbApi, path string, tableName string,
+	handler func(context middleware.Context, dbApi *DbApi, tableMeta core.Table)) {
+
+	operation := path
+	if len(operation) <= 0 {
+		operation = "get"
+	}
+	registerDatasourceRoute(dbApi, fmt.Sprintf("%s/%s", tableName, path),
+		func(context middleware.Context, dbApi *DbApi) {
+			tableMeta, ok := dbApi.lookupMeta(tableName)
+			if !ok || !dbApi.tableExposed(tableName) {
+				_ = context.ApiResponse(CodeNotFound, fmt.Sprintf("表 %s 不存在", tableName), nil)
+				return
+			}
+			if !dbApi.operationAllowed(tableName, operation) {
+				_ = context.ApiResponse(CodeForbidden, fmt.Sprintf("表 %s 不允许 %s 操作", tableName, operation), nil)
+				return
+			}
+			handler(context, dbApi, tableMeta)
+		})
+}
+
+// 获取表结构, 表不存在时返回false
+func (this *DbApi) lookupMeta(tableName string) (core.Table, bool) {
+	this.metaLock.RLock()
+	defer this.metaLock.RUnlock()
+	tableMeta, ok := this.tableMetas[tableName]
+	return tableMeta, ok
+}
+
+// 获取所有表结构
+func (this *DbApi) GetTables() []*core.Table {
+	this.metaLock.RLock()
+	defer this.metaLock.RUnlock()
+	return this.tables
+}
+
+// 获取表结构map, 重新加载时整体替换, 不会被修改
+func (this *DbApi) metas() map[string]core.Table {
+	this.metaLock.RLock()
+	defer this.metaLock.RUnlock()
+	return this.tableMetas
+}
+
+// 重新加载表结构
+//
+// 对比新旧表结构, 整体替换后为新增的开放表注册通用接口, 已删除的表接口返回不存在
+func (this *DbApi) reloadSchema() (schemaDiff, error) {
+	this.reloadLock.Lock()
+	defer this.reloadLock.Unlock()
+
+	diff := schemaDiff{
+		Added:   make([]string, 0),
+		Dropped: make([]string, 0),
+		Changed: make([]string, 0),
+	}
+	tablesMeta, err := this.GetEngine().DBMetas()
+	if err != nil {
+		return diff, errors.New(fmt.Sprintf("加载表结构错误 %s", err.Error()))
+	}
+	tables := make([]*core.Table, 0, len(tablesMeta))
+	tableMetas := make(map[string]core.Table)
+	for _, tableMeta := range tablesMeta {
+		tables = append(tables, tableMeta)
+		tableMetas[tableMeta.Name] = *tableMeta
+	}
+
+	oldMetas := this.metas()
+	for _, tableMeta := range tables {
+		oldMeta, ok := oldMetas[tableMeta.Name]
+		if !ok {
+			diff.Added = append(diff.Added, tableMeta.Name)
+		} else if tableSignature(oldMeta) != tableSignature(*tableMeta) {
+			diff.Changed = append(diff.Changed, tableMeta.Name)
+		}
+	}
+	for tableName := range oldMetas {
+		if _, ok := tableMetas[tableName]; !ok {
+			diff.Dropped = append(diff.Dropped, tableName)
+		}
+	}
+
+	this.metaLock.Lock()
+	this.tables = tables
+	this.tableMetas = tableMetas
+	this.metaLock.Unlock()
+
+	for _, tableName := range diff.Added {
+		if !this.tableExposed(tableName) {
+			continue
+		}
+		registerTableCommonApi(this, tableName)
+	}
+	if len(diff.Added)+len(diff.Dropped)+len(diff.Changed) > 0 {
+		Logger.InfoF("数据源 %s 表结构变化, 新增: %v, 删除: %v, 修改: %v",
+			this.name, diff.Added, diff.Dropped, diff.Changed)
+	}
+	return diff, nil
+}
+
+// 接口或定时任务重新加载表结构, 当前数据源为默认数据源时同时更新 Tables
+func (this *DbApi) reload() (schemaDiff, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	diff, err := this.reloadSchema()
+	if err != nil {
+		return diff, err
+	}
+	if GetDbApi("") == this {
+		Tables = this.GetTables()
+	}
+	return diff, nil
+}
+
+// 表结构签名, 用于判断表结构是否变化
+func tableSignature(tableMeta core.Table) string {
+	columns := make([]string, 0)
+	for _, column := range tableMeta.Columns() {
+		columns = append(columns, fmt.Sprintf("%s %s(%d,%d) %v %v",
+			column.Name, column.SQLType.Name, column.Length, column.Length2, column.Nullable, column.IsPrimaryKey))
+	}
+	return strings.Join(columns, ",")
+}
+
+// 注册重新加载表结构接口
+func registerSchemaReload(dbApi *DbApi) {
+	registerDatasourceRoute(dbApi, "/reload", func(context middleware.Context, dbApi *DbApi) {
+		diff, err := dbApi.reload()
+		if middleware.ProcessError(err) {
+			_ = context.ApiResponse(-1, err.Error(), nil)
+			return
+		}
+		_ = context.ApiResponse(0, "", diff)
+	})
+}
+
+// 定时重新加载表结构, db.schemaReloadInterval 配置间隔, 单位秒, 未配置时不启用
+func (this *DbApi) startSchemaReload() {
+	interval, err := middleware.ConfInt(dbConfig(), "db.schemaReloadInterval")
+	if err != nil || interval <= 0 {
+		return
+	}
+	this.stopSchemaReload()
+	done := make(chan struct{})
+	this.reloadDone = done
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := this.reload()
+				middleware.ProcessError(err)
+			}
+		}
+	}()
+}
+
+// 停止定时重新加载表结构
+func (this *DbApi) stopSchemaReload() {
+	if this.reloadDone != nil {
+		close(this.reloadDone)
+		this.reloadDone = nil
+	}
+}
@@ -0,0 +1,235 @@
+//go:build sqlite
+// +build sqlite
+
+package dbrest
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-xorm/xorm"
+	"github.com/wenlaizhou/middleware"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 使用临时文件创建sqlite数据源的配置, 执行建表语句
+//
+// 运行: go test -race -tags sqlite
+func sqliteConfig(t *testing.T, ddl ...string) middleware.Config {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "dbrest.db")
+	db, err := sql.Open(DriverSqlite, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range ddl {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return middleware.Config{
+		"db.driver":   DriverSqlite,
+		"db.database": file,
+		// 多个连接同时写入时等待锁
+		"db.params": "_busy_timeout=5000&_journal_mode=WAL",
+	}
+}
+
+// 创建sqlite数据源并初始化接口
+func initSqlite(t *testing.T, ddl ...string) *DbApi {
+	t.Helper()
+	InitDbApi(sqliteConfig(t, ddl...))
+	dbApi := GetDbApi("")
+	if dbApi == nil {
+		t.Fatal("sqlite数据源初始化失败")
+	}
+	return dbApi
+}
+
+// 调用已注册的接口, 可在多个goroutine中使用
+func serve(t *testing.T, path string, body string) *httptest.ResponseRecorder {
+	handler := routeHandler(path)
+	if handler == nil {
+		t.Errorf("接口 %s 未注册", path)
+		return nil
+	}
+	request := httptest.NewRequest(http.MethodPost, "/"+strings.TrimPrefix(path, "/"), strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler(middleware.Context{Request: request, Response: recorder})
+	return recorder
+}
+
+// xorm 解析sqlite表结构时关键字需大写
+const userTable = "CREATE TABLE user (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(32), age INTEGER)"
+
+func TestSqliteInsertSelect(t *testing.T) {
+	dbApi := initSqlite(t, userTable)
+	sqlConf := SqlConf{Table: "user"}
+	id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doInsert(session, sqlConf, map[string]interface{}{"name": "a", "age": 1}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := dbApi.readSession(true)
+	defer session.Close()
+	rows, err := doSelect(*session, sqlConf, map[string]interface{}{"name": "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("查询结果数量 %d", len(rows))
+	}
+	if rows[0]["id"] != id || rows[0]["age"] != int64(1) || rows[0]["name"] != "a" {
+		t.Fatalf("查询结果 %v, 插入id %v", rows[0], id)
+	}
+}
+
+// 表名及列名为关键字时按方言引用
+func TestSqliteReservedNames(t *testing.T) {
+	dbApi := initSqlite(t, `CREATE TABLE "order" (id INTEGER PRIMARY KEY AUTOINCREMENT, "group" VARCHAR(32), is_delete INTEGER DEFAULT 0)`)
+	sqlConf := SqlConf{Table: "order"}
+	id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doInsert(session, sqlConf, map[string]interface{}{"group": "a"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doUpdate(session, sqlConf, map[string]interface{}{"id": id, "group": "b"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := dbApi.readSession(true)
+	defer session.Close()
+	rows, err := doSelect(*session, sqlConf, map[string]interface{}{
+		"group": "b", "fields": "id,group", "order": "group"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["id"] != id {
+		t.Fatalf("查询结果 %v, 插入id %v", rows, id)
+	}
+	_, err = dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doDelete(session, sqlConf, map[string]interface{}{"id": id}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := doCount(*session, sqlConf, map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("删除后数量 %d", count)
+	}
+}
+
+const countSqlApi = `<sqlApis>
+	<sqlApi path="/count/users">
+		<sql type="count" table="user" id="total"></sql>
+	</sqlApi>
+</sqlApis>`
+
+// sql配置中的统计结果以数值返回
+func TestSqliteSqlApiCount(t *testing.T) {
+	dbApi := initSqlite(t, userTable)
+	_, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doBatchInsert(session, SqlConf{Table: "user"}, []map[string]interface{}{
+			{"name": "a", "age": 1}, {"name": "b", "age": 2}}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlApiFile := filepath.Join(t.TempDir(), "sqlApi.xml")
+	if err = ioutil.WriteFile(sqlApiFile, []byte(countSqlApi), 0644); err != nil {
+		t.Fatal(err)
+	}
+	InitSqlConfApi(sqlApiFile)
+	rows, err := ExecSqlConfApiTyped(map[string]interface{}{}, "/count/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["total"] != int64(2) {
+		t.Fatalf("统计结果 %v", rows)
+	}
+	stringRows, err := ExecSqlConfApi(map[string]interface{}{}, "/count/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stringRows) != 1 || stringRows[0]["total"] != "2" {
+		t.Fatalf("字符串统计结果 %v", stringRows)
+	}
+}
+
+// 只有主键时冲突不更新, 返回请求中的主键
+func TestSqliteUpsertDoNothing(t *testing.T) {
+	dbApi := initSqlite(t, userTable)
+	sqlConf := SqlConf{Table: "user"}
+	id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doInsert(session, sqlConf, map[string]interface{}{"name": "a"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsertId, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doUpsert(session, sqlConf, map[string]interface{}{"id": id}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upsertId != id {
+		t.Fatalf("返回主键 %v, 期望 %v", upsertId, id)
+	}
+}
+
+// 隐藏列不出现在表列表的索引及审计记录中
+func TestSqliteHiddenColumns(t *testing.T) {
+	conf := sqliteConfig(t,
+		"CREATE TABLE account (id INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(32), secret VARCHAR(32))",
+		"CREATE INDEX idx_name ON account (name, secret)")
+	conf["db.hiddenColumns"] = "secret"
+	conf["db.auditLog"] = "true"
+	InitDbApi(conf)
+	dbApi := GetDbApi("")
+	sqlConf := SqlConf{Table: "account"}
+	id, err := dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doInsert(session, sqlConf, map[string]interface{}{"name": "a", "secret": "hidden-value"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbApi.transaction(func(session xorm.Session) (interface{}, error) {
+		return doUpdate(session, sqlConf, map[string]interface{}{"id": id, "name": "b"}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := dbApi.GetEngine().QueryString(
+		fmt.Sprintf("select before_image, after_image from %s", auditLogTable()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("审计记录 %v", logs)
+	}
+	for _, log := range logs {
+		if strings.Contains(log["before_image"]+log["after_image"], "hidden-value") {
+			t.Fatalf("审计记录包含隐藏列 %v", log)
+		}
+	}
+
+	body := serve(t, "/tables", `{}`).Body.String()
+	if !strings.Contains(body, "idx_name") || strings.Contains(body, "secret") {
+		t.Fatalf("表列表 %s", body)
+	}
+}
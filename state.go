@@ -0,0 +1,86 @@
+package dbrest
+
+import (
+	"github.com/wenlaizhou/middleware"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 替换后旧数据源的关闭延迟, 等待处理中的请求完成
+const retireDelay = 30 * time.Second
+
+// 运行状态快照
+//
+// InitDbApi, InitSqlConfApi 可在服务运行中重复调用, 修改时复制当前快照, 修改完成后整体替换,
+// 处理请求时读取的快照不会被修改
+type runtimeState struct {
+	config  middleware.Config
+	dbApi   *DbApi
+	dbApis  map[string]*DbApi
+	sqlApis map[string]SqlApi
+	// 认证, 为nil时不认证
+	authenticator Authenticator
+	// 认证是否由 db.auth 配置创建, 配置删除时清除
+	authFromConfig bool
+}
+
+var state atomic.Value
+
+// 修改状态的调用互斥
+var stateLock = new(sync.Mutex)
+
+func init() {
+	state.Store(&runtimeState{
+		config:  make(middleware.Config),
+		dbApis:  make(map[string]*DbApi),
+		sqlApis: make(map[string]SqlApi),
+	})
+}
+
+// 获取当前状态快照
+func loadState() *runtimeState {
+	return state.Load().(*runtimeState)
+}
+
+// 复制当前状态, 修改后替换, 调用方需持有 stateLock
+func updateState(update func(s *runtimeState)) {
+	old := loadState()
+	s := &runtimeState{
+		config:         old.config,
+		dbApi:          old.dbApi,
+		dbApis:         make(map[string]*DbApi, len(old.dbApis)),
+		sqlApis:        make(map[string]SqlApi, len(old.sqlApis)),
+		authenticator:  old.authenticator,
+		authFromConfig: old.authFromConfig,
+	}
+	for name, dbApi := range old.dbApis {
+		s.dbApis[name] = dbApi
+	}
+	for path, sqlApi := range old.sqlApis {
+		s.sqlApis[path] = sqlApi
+	}
+	update(s)
+	state.Store(s)
+}
+
+// 当前配置
+func dbConfig() middleware.Config {
+	return loadState().config
+}
+
+// 获取当前配置, 不能修改返回的配置
+func GetConfig() middleware.Config {
+	return dbConfig()
+}
+
+// 停止被替换的数据源的后台任务, 延迟关闭数据库连接
+func (this *DbApi) retire() {
+	this.stop()
+	time.AfterFunc(retireDelay, func() {
+		middleware.ProcessError(this.orm.Close())
+		for _, r := range this.replicas {
+			middleware.ProcessError(r.orm.Close())
+		}
+	})
+}
@@ -0,0 +1,132 @@
+//go:build sqlite
+// +build sqlite
+
+package dbrest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	raceWorkers = 4
+	raceRounds  = 20
+)
+
+const raceSqlApi = `<sqlApis>
+	<sqlApi path="/race/users">
+		<sql>select * from user where age >= ${age}</sql>
+	</sqlApi>
+</sqlApis>`
+
+// 重新初始化配置, sql配置及重新加载表结构时接口正常处理请求
+//
+// 运行: go test -race -tags sqlite -run TestConcurrent
+func TestConcurrentInitAndServe(t *testing.T) {
+	conf := sqliteConfig(t, userTable)
+	InitDbApi(conf)
+	sqlApiFile := filepath.Join(t.TempDir(), "sqlApi.xml")
+	if err := ioutil.WriteFile(sqlApiFile, []byte(raceSqlApi), 0644); err != nil {
+		t.Fatal(err)
+	}
+	InitSqlConfApi(sqlApiFile)
+
+	var wg sync.WaitGroup
+	run := func(action func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < raceRounds; i++ {
+				action(i)
+			}
+		}()
+	}
+	run(func(int) {
+		InitDbApi(conf)
+	})
+	run(func(int) {
+		InitSqlConfApi(sqlApiFile)
+	})
+	run(func(i int) {
+		dbApi := GetDbApi("")
+		_, err := dbApi.GetEngine().Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS race_%d (id INTEGER PRIMARY KEY)", i))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = dbApi.reload(); err != nil {
+			t.Error(err)
+		}
+	})
+	for w := 0; w < raceWorkers; w++ {
+		w := w
+		run(func(i int) {
+			serve(t, "user/insert", fmt.Sprintf(`{"name" : "u%d_%d", "age" : %d}`, w, i, i))
+			serve(t, "user/select", `{"age" : {"gte" : 0}}`)
+			serve(t, "/sql", `{"sql" : "select count(*) as total from user"}`)
+			serve(t, "/race/users", `{"age" : 0}`)
+			serve(t, "/tables", `{}`)
+		})
+	}
+	wg.Wait()
+
+	// 初始化及重新加载期间的请求都已处理
+	session := GetDbApi("").readSession(true)
+	defer session.Close()
+	count, err := doCount(*session, SqlConf{Table: "user"}, map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != raceWorkers*raceRounds {
+		t.Fatalf("插入数据 %d 条, 期望 %d 条", count, raceWorkers*raceRounds)
+	}
+	// 重新加载后新增的表可以访问, 重新初始化后仍然保留
+	for i := 0; i < raceRounds; i++ {
+		tableName := fmt.Sprintf("race_%d", i)
+		if _, ok := GetDbApi("").lookupMeta(tableName); !ok {
+			t.Errorf("表 %s 没有加载", tableName)
+		}
+		if routeHandler(fmt.Sprintf("%s/select", tableName)) == nil {
+			t.Errorf("表 %s 没有注册接口", tableName)
+		}
+	}
+}
+
+type pet struct {
+	Id   int64  `xorm:"'id' pk autoincr" json:"id"`
+	Name string `xorm:"'name' varchar(32)" json:"name"`
+}
+
+func (pet) TableName() string {
+	return "pet"
+}
+
+// 重新初始化后结构体接口使用新的数据源, 原数据源关闭后仍然可用
+func TestStructRouteAfterReinit(t *testing.T) {
+	conf := sqliteConfig(t)
+	InitDbApi(conf)
+	GetDbApi("").RegisterDbApi(&pet{})
+	old := GetDbApi("")
+	InitDbApi(conf)
+	if _, ok := GetDbApi("").GetStruct()["pet"]; !ok {
+		t.Fatal("重新初始化后结构体没有保留")
+	}
+	// 不等待 retireDelay, 直接关闭原数据源
+	if err := old.GetEngine().Close(); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, "/pet/insert", `{"name" : "a"}`)
+
+	session := GetDbApi("").readSession(true)
+	defer session.Close()
+	count, err := doCount(*session, SqlConf{Table: "pet"}, map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("插入数据 %d 条, 期望 1 条", count)
+	}
+}